@@ -5,27 +5,51 @@ import (
 	"context"
 	"embed"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"log/slog"
 	"net/http"
+	"net/netip"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"regexp"
+	"slices"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
+	"github.com/jasonthorsness/ginprov/fake"
 	"github.com/jasonthorsness/ginprov/gemini"
+	"github.com/jasonthorsness/ginprov/generation"
+	"github.com/jasonthorsness/ginprov/metrics"
+	"github.com/jasonthorsness/ginprov/openai"
+	"github.com/jasonthorsness/ginprov/sanitize"
 	"github.com/jasonthorsness/ginprov/server"
+	"github.com/jasonthorsness/ginprov/tracing"
 	"github.com/joho/godotenv"
 	"github.com/spf13/cobra"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel/attribute"
 	"golang.org/x/net/html"
 )
 
-//go:embed index.html notfound.html banner.html safety.html favicon.ico robots.txt
+var (
+	_ server.Provider = (*gemini.Client)(nil)
+	_ server.Provider = (*fake.Client)(nil)
+	_ server.Provider = (*openai.Client)(nil)
+
+	_ server.VisionProvider = (*gemini.Client)(nil)
+	_ server.VisionProvider = (*fake.Client)(nil)
+	_ server.VisionProvider = (*openai.Client)(nil)
+)
+
+//go:embed index.html notfound.html banner.html safety.html budget.html favicon.ico robots.txt
 var staticFiles embed.FS
 
 func findHeadAndBody(doc *html.Node) (*html.Node, *html.Node) {
@@ -165,7 +189,14 @@ func insertBannerIframe(body *html.Node) error {
 				Key: "style",
 				Val: "position: fixed !important; top: 0 !important; left: 0 !important; " +
 					"right: 0 !important; z-index: 999999 !important; border: none !important; " +
-					"height: 80px !important; width: 100% !important;",
+					"height: 80px !important; width: 100% !important; " +
+					// an inline !important beats any style sheet, so the page can't hide the banner by selecting it
+					"display: block !important; visibility: visible !important; opacity: 1 !important; " +
+					"transform: none !important; filter: none !important; clip-path: none !important; " +
+					"mask: none !important; scale: none !important; translate: none !important; " +
+					"rotate: none !important; zoom: 1 !important; margin: 0 !important; " +
+					"max-height: none !important; max-width: none !important; " +
+					"content-visibility: visible !important;",
 				Namespace: "",
 			},
 			{Key: "scrolling", Val: "no", Namespace: ""},
@@ -210,20 +241,85 @@ func createDefaultTransformer(prefix, baseURL string) server.HTMLTransformer {
 }
 
 type Config struct {
-	host       string
-	contentDir string
-	baseURL    string
-	port       int
+	host            string
+	contentDir      string
+	baseURL         string
+	provider        string
+	record          string
+	replay          string
+	openaiBaseURL   string
+	otlpEndpoint    string
+	textModel       string
+	imageModel      string
+	siteBudgets     []string
+	trustedProxies  []string
+	scheduling      string
+	moderation      string
+	moderationWords string
+	priorityWeights []int
+	allowElements   []string
+	allowAttributes []string
+	dropElements    []string
+	defaults        generation.Defaults
+	policy          *sanitize.Policy
+	pricing         Pricing
+	cancelPolicy    server.CancelPolicy
+	securityHeaders server.SecurityHeaders
+	shutdownTimeout time.Duration
+	siteWork        server.GroupLimits
+	globalLimits    server.Limits
+	siteLimits      server.Limits
+	port            int
+	rateBurst       int
+	ratePerMinute   float64
+	temperature     float32
+	topP            float32
+	seed            int32
+	maxOutputTokens int32
+	accessLog       bool
 }
 
-func createRootCmd() *cobra.Command {
+// createRootCmd returns the command that parses flags into a Config and passes it to run.
+func createRootCmd(run func(cmd *cobra.Command, args []string, config *Config) error) *cobra.Command {
 	const defaultPort = 8080
 
 	config := &Config{
-		port:       defaultPort,
-		host:       "localhost",
-		baseURL:    "",
-		contentDir: "",
+		port:            defaultPort,
+		host:            "localhost",
+		baseURL:         "",
+		contentDir:      "",
+		provider:        providerGemini,
+		record:          "",
+		replay:          "",
+		openaiBaseURL:   "",
+		otlpEndpoint:    "",
+		textModel:       "",
+		imageModel:      "",
+		defaults:        generation.Defaults{Text: generation.Options{}, Image: generation.Options{}},
+		pricing:         Pricing{InputPerMillion: 0, OutputPerMillion: 0, PerImage: 0},
+		cancelPolicy:    server.CancelPolicy{Grace: 0, FinishAfter: 0},
+		securityHeaders: *server.DefaultSecurityHeaders(),
+		shutdownTimeout: 0,
+		siteWork:        server.GroupLimits{Workers: 0, Queued: 0},
+		siteBudgets:     nil,
+		globalLimits:    server.Limits{Tokens: 0, Images: 0},
+		siteLimits:      server.Limits{Tokens: 0, Images: 0},
+		trustedProxies:  nil,
+		scheduling:      schedulingWeighted,
+		moderation:      moderationOff,
+		moderationWords: "",
+		priorityWeights: nil,
+		allowElements:   nil,
+		allowAttributes: nil,
+		dropElements:    nil,
+		policy:          nil,
+		rateBurst:       0,
+		ratePerMinute:   0,
+		temperature:     0,
+		topP:            0,
+		seed:            0,
+		maxOutputTokens: 0,
+		accessLog:       true,
 	}
 
 	rootCmd := &cobra.Command{
@@ -231,7 +327,8 @@ func createRootCmd() *cobra.Command {
 		Short: "✨ An Improvisational Web Server ✨",
 		Long:  "ginprov generates web pages and images based on their URL paths",
 		RunE: func(cmd *cobra.Command, args []string) error {
-			return runServer(cmd, args, config)
+			config.defaults = generationDefaults(cmd, config)
+			return run(cmd, args, config)
 		},
 	}
 
@@ -246,11 +343,154 @@ func createRootCmd() *cobra.Command {
 		"",
 		"The path to the location for generated HTML and images")
 
+	rootCmd.Flags().StringVar(
+		&config.provider,
+		"provider",
+		providerGemini,
+		"Content generation backend: "+providerGemini+", "+providerOpenAI+" (any OpenAI-compatible server) or "+
+			providerFake+" (deterministic, offline)")
+
+	rootCmd.Flags().StringVar(&config.record, "record", "",
+		"Append every Gemini response stream to this cassette file")
+	rootCmd.Flags().StringVar(&config.replay, "replay", "",
+		"Serve Gemini responses from this cassette file instead of calling Gemini")
+	rootCmd.MarkFlagsMutuallyExclusive("record", "replay")
+
+	rootCmd.Flags().StringVar(&config.openaiBaseURL, "openai-base-url", "http://localhost:8000/v1",
+		"Base URL of the OpenAI-compatible API, used with --provider="+providerOpenAI+
+			" (API key is read from OPENAI_API_KEY)")
+
+	rootCmd.Flags().StringVar(&config.textModel, "text-model", "",
+		"Model for HTML and outlines (default depends on the provider)")
+	rootCmd.Flags().StringVar(&config.imageModel, "image-model", "",
+		"Model for images (default depends on the provider)")
+
+	// the names of the model flags from when only the OpenAI-compatible provider had them
+	rootCmd.Flags().StringVar(&config.textModel, "openai-text-model", "", "Same as --text-model")
+	rootCmd.Flags().StringVar(&config.imageModel, "openai-image-model", "", "Same as --image-model")
+	_ = rootCmd.Flags().MarkDeprecated("openai-text-model", "use --text-model instead")
+	_ = rootCmd.Flags().MarkDeprecated("openai-image-model", "use --image-model instead")
+	rootCmd.Flags().Float32Var(&config.temperature, "temperature", 0,
+		"Sampling temperature for HTML and outlines (default depends on the model)")
+	rootCmd.Flags().Float32Var(&config.topP, "top-p", 0,
+		"Nucleus sampling probability for HTML and outlines (default depends on the model)")
+	rootCmd.Flags().Int32Var(&config.maxOutputTokens, "max-output-tokens", 0,
+		"Maximum output tokens for HTML and outlines (default depends on the model)")
+	rootCmd.Flags().Int32Var(&config.seed, "seed", 0,
+		"Seed for both text and image generation (default random)")
+
+	rootCmd.Flags().Float64Var(&config.pricing.InputPerMillion, "cost-input-per-million", 0,
+		"Cost per million input tokens, for the estimates in /api/usage")
+	rootCmd.Flags().Float64Var(&config.pricing.OutputPerMillion, "cost-output-per-million", 0,
+		"Cost per million output tokens, for the estimates in /api/usage")
+	rootCmd.Flags().Float64Var(&config.pricing.PerImage, "cost-per-image", 0,
+		"Cost per generated image, for the estimates in /api/usage")
+
+	rootCmd.Flags().Int64Var(&config.globalLimits.Tokens, "daily-tokens", 0,
+		"Tokens all sites together may use per UTC day (0 for no limit)")
+	rootCmd.Flags().Int64Var(&config.globalLimits.Images, "daily-images", 0,
+		"Images all sites together may generate per UTC day (0 for no limit)")
+	rootCmd.Flags().Int64Var(&config.siteLimits.Tokens, "site-daily-tokens", 0,
+		"Tokens each site may use per UTC day (0 for no limit)")
+	rootCmd.Flags().Int64Var(&config.siteLimits.Images, "site-daily-images", 0,
+		"Images each site may generate per UTC day (0 for no limit)")
+	rootCmd.Flags().StringArrayVar(&config.siteBudgets, "site-budget", nil,
+		"Daily limits for one site as SITE=TOKENS:IMAGES, overriding --site-daily-* (repeatable)")
+
+	const defaultRateBurst = 10
+
+	rootCmd.Flags().Float64Var(&config.ratePerMinute, "rate-limit", 0,
+		"New pages and images each client may generate per minute (0 for no limit)")
+	rootCmd.Flags().IntVar(&config.rateBurst, "rate-burst", defaultRateBurst,
+		"New pages and images each client may generate at once before --rate-limit applies")
+	rootCmd.Flags().StringSliceVar(&config.trustedProxies, "trusted-proxy", nil,
+		"IP or CIDR of a reverse proxy whose X-Forwarded-For identifies the client (repeatable)")
+	rootCmd.Flags().BoolVar(&config.accessLog, "access-log", true,
+		"Log every request with its status, size, duration and whether it was served, generated or joined")
+
+	headers := server.DefaultSecurityHeaders()
+
+	rootCmd.Flags().StringVar(&config.securityHeaders.ContentSecurityPolicy, "content-security-policy",
+		headers.ContentSecurityPolicy, "Content-Security-Policy for generated pages and images (none if empty)")
+	rootCmd.Flags().StringVar(&config.securityHeaders.ReferrerPolicy, "referrer-policy", headers.ReferrerPolicy,
+		"Referrer-Policy for generated pages and images (none if empty)")
+	rootCmd.Flags().StringVar(&config.securityHeaders.PermissionsPolicy, "permissions-policy",
+		headers.PermissionsPolicy, "Permissions-Policy for generated pages and images (none if empty)")
+
+	rootCmd.Flags().StringArrayVar(&config.allowElements, "allow-element", nil,
+		"Keep an element the sanitizer would remove, as NAME or NAME=ATTRIBUTE,... to also keep attributes on it "+
+			"(repeatable)")
+	rootCmd.Flags().StringSliceVar(&config.allowAttributes, "allow-attribute", nil,
+		"Keep an attribute on every kept element (repeatable)")
+	rootCmd.Flags().StringSliceVar(&config.dropElements, "drop-element", nil,
+		"Remove an element along with everything inside it, even if --allow-element keeps it (repeatable)")
+
+	rootCmd.Flags().StringVar(&config.moderation, "moderation", moderationOff,
+		"Review every generated page and image before saving it: "+moderationOff+" or "+moderationProvider+
+			" (ask the provider, which reviews images only if it supports image input)")
+	rootCmd.Flags().StringVar(&config.moderationWords, "moderation-words", "",
+		"File of whitespace-separated words that flag a generated page without asking the provider")
+
+	const defaultCancelGrace = 10 * time.Second
+
+	rootCmd.Flags().DurationVar(&config.cancelPolicy.Grace, "cancel-grace", defaultCancelGrace,
+		"How long a generation continues after every client waiting on it has gone (negative to never cancel)")
+	rootCmd.Flags().IntVar(&config.cancelPolicy.FinishAfter, "finish-after-bytes", 0,
+		"Let abandoned generations that have already streamed this many bytes finish anyway (0 to always cancel)")
+
+	rootCmd.Flags().StringVar(&config.otlpEndpoint, "otlp-endpoint", "",
+		"OTLP/HTTP endpoint to export traces to, such as http://localhost:4318 (no tracing if empty)")
+
+	const defaultShutdownTimeout = 30 * time.Second
+
+	rootCmd.Flags().DurationVar(&config.shutdownTimeout, "shutdown-timeout", defaultShutdownTimeout,
+		"On SIGINT or SIGTERM, how long to let generations in progress finish before exiting")
+
+	rootCmd.Flags().StringVar(&config.scheduling, "scheduling", schedulingWeighted,
+		"How queued work is prioritized: "+schedulingStrict+" (pages, then images, then prefetches) or "+
+			schedulingWeighted+" (each gets a share per --priority-weights)")
+	rootCmd.Flags().IntSliceVar(&config.priorityWeights, "priority-weights", []int{6, 3, 1}, //nolint:mnd
+		"Starts per round for pages, images and prefetches with --scheduling="+schedulingWeighted)
+
+	const (
+		defaultSiteWorkers = 25
+		defaultSiteQueue   = 250
+	)
+
+	rootCmd.Flags().IntVar(&config.siteWork.Workers, "site-workers", defaultSiteWorkers,
+		"Most generations one site may run at once (0 for no limit)")
+	rootCmd.Flags().IntVar(&config.siteWork.Queued, "site-queue", defaultSiteQueue,
+		"Most generations one site may have waiting for a worker (0 for no limit)")
+
 	return rootCmd
 }
 
+// generationDefaults converts the generation flags to provider defaults. Parameters that were not set on the
+// command line are left to the provider.
+func generationDefaults(cmd *cobra.Command, config *Config) generation.Defaults {
+	text := generation.Options{Model: config.textModel}
+	image := generation.Options{Model: config.imageModel}
+
+	if cmd.Flags().Changed("temperature") {
+		text.Temperature = &config.temperature
+	}
+
+	if cmd.Flags().Changed("top-p") {
+		text.TopP = &config.topP
+	}
+
+	if cmd.Flags().Changed("seed") {
+		text.Seed = &config.seed
+		image.Seed = &config.seed
+	}
+
+	text.MaxOutputTokens = config.maxOutputTokens
+
+	return generation.Defaults{Text: text, Image: image}
+}
+
 func main() {
-	rootCmd := createRootCmd()
+	rootCmd := createRootCmd(runServer)
 
 	err := rootCmd.Execute()
 	if err != nil {
@@ -260,17 +500,36 @@ func main() {
 
 const maxPrefixLength = 40
 
+// isPrefix reports whether v names a site: lower-case letters and digits, optionally separated by hyphens, as the
+// router makes them.
+func isPrefix(prefixRe *regexp.Regexp, v string) bool {
+	prefix := strings.ToLower(v)
+	prefix = prefixRe.ReplaceAllString(prefix, "-")
+	prefix = strings.Trim(prefix, "-")
+
+	return prefix != "" && prefix == v && len(prefix) <= maxPrefixLength
+}
+
 //nolint:cyclop
 func createHTTPHandler(
 	config *Config,
 	prefixRe *regexp.Regexp,
 	root *os.Root,
 	rootPath string,
-	gen *gemini.Client,
+	gen server.Provider,
 	workerPool *server.WorkerPool,
+	budget *server.DailyBudget,
+	limiter server.RateLimiter,
+	moderator server.Moderator,
+	m *server.Metrics,
 	servers map[string]*server.Server,
 	mu *sync.Mutex,
 ) http.HandlerFunc {
+	serverFor := cachedServers(servers, mu, func(prefix string) (*server.Server, error) {
+		return newServer(
+			root, filepath.Join(rootPath, prefix), gen, workerPool, budget, limiter, moderator, m, prefix, config)
+	})
+
 	return func(w http.ResponseWriter, r *http.Request) {
 		path := strings.TrimLeft(r.URL.Path, "/")
 
@@ -299,13 +558,37 @@ func createHTTPHandler(
 			return
 		}
 
-		raw, path, ok := strings.Cut(path, "/")
+		if path == "api/usage" {
+			handleUsageAPI(w, root, config.pricing)
+			return
+		}
 
-		prefix := strings.ToLower(raw)
-		prefix = prefixRe.ReplaceAllString(prefix, "-")
-		prefix = strings.Trim(prefix, "-")
+		if site, ok := strings.CutPrefix(path, "api/usage/"); ok {
+			if !isPrefix(prefixRe, site) {
+				http.Error(w, "Site not found", http.StatusNotFound)
+				return
+			}
+
+			handleSiteUsageAPI(w, root, site, config.pricing)
 
-		if prefix != raw || len(prefix) > maxPrefixLength {
+			return
+		}
+
+		if v, ok := strings.CutPrefix(path, "api/status/"); ok {
+			site, slug, _ := strings.Cut(v, "/")
+			if !isPrefix(prefixRe, site) {
+				http.Error(w, "Site not found", http.StatusNotFound)
+				return
+			}
+
+			handleStatusAPI(w, root, site, slug, serverFor)
+
+			return
+		}
+
+		prefix, path, ok := strings.Cut(path, "/")
+
+		if !isPrefix(prefixRe, prefix) {
 			handleStaticFile(w, "notfound.html", "text/html; charset=utf-8", root)
 			return
 		}
@@ -315,24 +598,19 @@ func createHTTPHandler(
 			return
 		}
 
-		mu.Lock()
-		defer mu.Unlock()
+		server.AccessFrom(r.Context()).Prefix = prefix
 
-		s, ok := servers[prefix]
-		if !ok {
-			var err error
-
-			s, err = newServer(root, filepath.Join(rootPath, prefix), gen, workerPool, prefix, config)
-			if err != nil {
-				http.Error(
-					w,
-					fmt.Sprintf("Failed to create server for prefix %s: %v", prefix, err),
-					http.StatusInternalServerError)
+		_, span := tracing.Start(r.Context(), "route", attribute.String("prefix", prefix))
+		s, err := serverFor(prefix)
+		tracing.End(span, err)
 
-				return
-			}
+		if err != nil {
+			http.Error(
+				w,
+				fmt.Sprintf("Failed to create server for prefix %s: %v", prefix, err),
+				http.StatusInternalServerError)
 
-			servers[prefix] = s
+			return
 		}
 
 		r.URL.Path = path
@@ -340,6 +618,33 @@ func createHTTPHandler(
 	}
 }
 
+// cachedServers returns a function that finds the Server for a prefix, creating it on first use. The lock is only
+// held for the lookup so requests to different pages run concurrently.
+func cachedServers(
+	servers map[string]*server.Server,
+	mu *sync.Mutex,
+	create func(prefix string) (*server.Server, error),
+) func(prefix string) (*server.Server, error) {
+	return func(prefix string) (*server.Server, error) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		s, ok := servers[prefix]
+		if ok {
+			return s, nil
+		}
+
+		s, err := create(prefix)
+		if err != nil {
+			return nil, err
+		}
+
+		servers[prefix] = s
+
+		return s, nil
+	}
+}
+
 func runServer(_ *cobra.Command, _ []string, config *Config) error {
 	prefixRe := regexp.MustCompile(`[^a-z0-9]`)
 
@@ -347,19 +652,11 @@ func runServer(_ *cobra.Command, _ []string, config *Config) error {
 
 	_ = godotenv.Load(".env.local")
 
-	apiKey := os.Getenv("GEMINI_API_KEY")
-	if apiKey == "" {
-		println("❌ GEMINI_API_KEY not set!")
-		println("Please set the GEMINI_API_KEY environment variable or create a .env.local file with the key.")
-		println("You can obtain an API key FREE from https://aistudio.google.com/apikey.")
-		os.Exit(1)
-	}
-
 	ctx := context.Background()
 
-	gen, err := gemini.New(ctx, apiKey)
+	gen, err := newProvider(ctx, config)
 	if err != nil {
-		return fmt.Errorf("failed to create gemini client: %w", err)
+		return err
 	}
 
 	contentDir := config.contentDir
@@ -384,42 +681,232 @@ func runServer(_ *cobra.Command, _ []string, config *Config) error {
 		return fmt.Errorf("failed to open content directory: %w", err)
 	}
 
+	if config.otlpEndpoint != "" {
+		shutdownTracing, tracingErr := tracing.Setup(ctx, config.otlpEndpoint)
+		if tracingErr != nil {
+			return tracingErr
+		}
+
+		defer func() {
+			const flushTimeout = 5 * time.Second
+
+			flushCtx, cancel := context.WithTimeout(context.Background(), flushTimeout)
+			defer cancel()
+
+			tracingErr = shutdownTracing(flushCtx)
+			if tracingErr != nil {
+				slog.Warn("failed to flush traces", "error", tracingErr)
+			}
+		}()
+
+		println("Exporting traces to " + config.otlpEndpoint)
+	}
+
+	removed, err := server.RemoveTempFiles(root)
+	if err != nil {
+		return err
+	}
+
+	if removed > 0 {
+		println(fmt.Sprintf("Removed %d temporary files left by an earlier run", removed))
+	}
+
+	overrides, err := parseSiteBudgets(config.siteBudgets)
+	if err != nil {
+		return err
+	}
+
+	config.policy, err = newPolicy(config)
+	if err != nil {
+		return err
+	}
+
+	budget, err := server.NewDailyBudget(root, contentDir, config.globalLimits, config.siteLimits, overrides)
+	if err != nil {
+		return fmt.Errorf("failed to load budget: %w", err)
+	}
+
+	trusted, err := parseTrustedProxies(config.trustedProxies)
+	if err != nil {
+		return err
+	}
+
+	limiter := newRateLimiter(config, trusted)
+
 	servers := make(map[string]*server.Server)
 	var mu sync.Mutex
 
 	const numWorkers = 100
 	const workChannelCapacityPerWorker = 10
 
-	workerPool := server.NewWorkerPool(numWorkers, numWorkers*workChannelCapacityPerWorker)
+	weights, err := priorityWeights(config)
+	if err != nil {
+		return err
+	}
+
+	workerPool := server.NewWorkerPool(numWorkers, numWorkers*workChannelCapacityPerWorker, weights, config.siteWork)
+
+	registry := metrics.NewRegistry()
+	m := server.NewMetrics(registry, workerPool)
+
+	moderator, err := newModerator(config, gen)
+	if err != nil {
+		return err
+	}
 
-	handler := createHTTPHandler(config, prefixRe, root, contentDir, gen, workerPool, servers, &mu)
+	handler := createHTTPHandler(
+		config, prefixRe, root, contentDir, gen, workerPool, budget, limiter, moderator, m, servers, &mu)
 	http.HandleFunc("/", handler)
+	http.Handle("/metrics", registry)
+
+	const pingInterval = 30 * time.Second
+
+	http.HandleFunc("/healthz", server.Healthz)
+	http.Handle("/readyz", server.NewReadiness(root, workerPool, gen, pingInterval))
 
 	addr := fmt.Sprintf("%s:%d", config.host, config.port)
 
 	const readHeaderTimeout = 3 * time.Second
 
+	var mux http.Handler = http.DefaultServeMux
+	if config.accessLog {
+		mux = server.AccessLog(slog.Default(), trusted, mux)
+	}
+
 	s := &http.Server{
 		Addr:              addr,
+		Handler:           otelhttp.NewHandler(mux, tracing.ServiceName),
 		ReadHeaderTimeout: readHeaderTimeout,
 	}
 
 	println("Serving from " + contentDir)
 	println("Listening on http://" + addr)
 
-	err = s.ListenAndServe()
-	if err != nil {
+	return serve(s, workerPool, config.shutdownTimeout)
+}
+
+// serve runs s until SIGINT or SIGTERM, then shuts down gracefully: new generations are refused while those already
+// accepted get up to timeout to finish, and then a few seconds more to be delivered. Existing pages are served until
+// the end. A second signal exits immediately.
+func serve(s *http.Server, workerPool *server.WorkerPool, timeout time.Duration) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	errCh := make(chan error, 1)
+
+	go func() {
+		errCh <- s.ListenAndServe()
+	}()
+
+	select {
+	case err := <-errCh:
 		return fmt.Errorf("server failed: %w", err)
+	case <-ctx.Done():
+	}
+
+	stop()
+
+	println("Shutting down, waiting up to " + timeout.String() + " for generations in progress...")
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	err := workerPool.Shutdown(shutdownCtx)
+	if err != nil {
+		slog.Warn("generations did not finish in time", "error", err)
+	}
+
+	// with the pool drained, the remaining requests only need to write their results
+	const httpShutdownTimeout = 5 * time.Second
+
+	httpCtx, httpCancel := context.WithTimeout(context.Background(), httpShutdownTimeout)
+	defer httpCancel()
+
+	err = s.Shutdown(httpCtx)
+	if err != nil {
+		slog.Warn("requests did not finish in time", "error", err)
+		_ = s.Close()
 	}
 
 	return nil
 }
 
+const (
+	providerGemini = "gemini"
+	providerOpenAI = "openai"
+	providerFake   = "fake"
+)
+
+var ErrUnknownProvider = errors.New("unknown provider")
+
+func newProvider(ctx context.Context, config *Config) (server.Provider, error) {
+	switch config.provider {
+	case providerGemini:
+		if config.replay != "" {
+			println("📼 Replaying Gemini responses from " + config.replay)
+
+			gen, err := gemini.NewReplaying(config.replay, config.defaults)
+			if err != nil {
+				return nil, fmt.Errorf("failed to create gemini client: %w", err)
+			}
+
+			return gen, nil
+		}
+
+		apiKey := os.Getenv("GEMINI_API_KEY")
+		if apiKey == "" {
+			println("❌ GEMINI_API_KEY not set!")
+			println("Please set the GEMINI_API_KEY environment variable or create a .env.local file with the key.")
+			println("You can obtain an API key FREE from https://aistudio.google.com/apikey.")
+			println("Or run with --provider=" + providerFake + " to try ginprov offline.")
+			os.Exit(1)
+		}
+
+		if config.record != "" {
+			println("📼 Recording Gemini responses to " + config.record)
+
+			gen, err := gemini.NewRecording(ctx, apiKey, config.record, config.defaults)
+			if err != nil {
+				return nil, fmt.Errorf("failed to create gemini client: %w", err)
+			}
+
+			return gen, nil
+		}
+
+		gen, err := gemini.New(ctx, apiKey, config.defaults)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create gemini client: %w", err)
+		}
+
+		return gen, nil
+	case providerOpenAI:
+		println("🔌 Using the OpenAI-compatible API at " + config.openaiBaseURL)
+
+		return openai.New(openai.Config{
+			BaseURL:  config.openaiBaseURL,
+			APIKey:   os.Getenv("OPENAI_API_KEY"),
+			Defaults: config.defaults,
+		}), nil
+	case providerFake:
+		println("🧪 Using the fake provider, content is placeholder only")
+
+		const fakeDelay = 10 * time.Millisecond
+
+		return fake.New(fakeDelay, config.defaults), nil
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnknownProvider, config.provider)
+	}
+}
+
 func newServer(
 	root *os.Root,
 	rootPath string,
-	gen *gemini.Client,
+	gen server.Provider,
 	workerPool *server.WorkerPool,
+	budget *server.DailyBudget,
+	limiter server.RateLimiter,
+	moderator server.Moderator,
+	m *server.Metrics,
 	prefix string,
 	config *Config,
 ) (*server.Server, error) {
@@ -442,17 +929,222 @@ func newServer(
 		}
 	}
 
-	prompter := server.NewPrompter(gen, prefix, rr, rootPath)
+	prompter := server.NewPrompter(gen, prefix, rr, rootPath, m)
 
 	transformer := createDefaultTransformer(prefix, config.baseURL)
-	site := server.NewSite(gen, prompter, rr, rootPath, transformer)
+	site := server.NewSite(
+		gen, prompter, rr, rootPath, config.policy, &config.securityHeaders, moderator, transformer, budget.Site(prefix), m)
 
 	var unsafeHandler server.HandleFunc = func(w http.ResponseWriter) error {
 		handleStaticFile(w, "safety.html", "text/html; charset=utf-8", root)
 		return nil
 	}
 
-	return server.NewServer(site, workerPool, slog.Default(), &server.DefaultProgressWriter{}, unsafeHandler), nil
+	var budgetHandler server.HandleFunc = func(w http.ResponseWriter) error {
+		handleBudgetExhausted(w, root)
+		return nil
+	}
+
+	return server.NewServer(
+		site,
+		workerPool,
+		prefix,
+		slog.Default(),
+		&server.DefaultProgressWriter{},
+		unsafeHandler,
+		budgetHandler,
+		limiter,
+		config.cancelPolicy,
+		m), nil
+}
+
+var ErrInvalidPolicy = errors.New("invalid --allow-element, --allow-attribute or --drop-element")
+
+// newPolicy returns sanitize.DefaultPolicy changed by --allow-element, --allow-attribute and --drop-element. Names
+// are not case-sensitive.
+func newPolicy(config *Config) (*sanitize.Policy, error) {
+	policy := sanitize.DefaultPolicy()
+
+	for _, v := range config.allowElements {
+		name, attributes, ok := strings.Cut(strings.ToLower(v), "=")
+
+		names := []string{name}
+		if ok {
+			names = append(names, strings.Split(attributes, ",")...)
+		}
+
+		if slices.Contains(names, "") {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidPolicy, v)
+		}
+
+		policy.Elements[name] = append(policy.Elements[name], names[1:]...)
+		policy.Drop = slices.DeleteFunc(policy.Drop, func(d string) bool { return d == name })
+	}
+
+	for _, v := range config.allowAttributes {
+		if v == "" {
+			return nil, fmt.Errorf("%w: empty attribute", ErrInvalidPolicy)
+		}
+
+		policy.Attributes = append(policy.Attributes, strings.ToLower(v))
+	}
+
+	for _, v := range config.dropElements {
+		if v == "" {
+			return nil, fmt.Errorf("%w: empty element", ErrInvalidPolicy)
+		}
+
+		name := strings.ToLower(v)
+		delete(policy.Elements, name)
+
+		if !slices.Contains(policy.Drop, name) {
+			policy.Drop = append(policy.Drop, name)
+		}
+	}
+
+	return policy, nil
+}
+
+const (
+	schedulingStrict   = "strict"
+	schedulingWeighted = "weighted"
+)
+
+var ErrInvalidScheduling = errors.New("invalid scheduling")
+
+// priorityWeights returns the weights for server.NewWorkerPool, which are nil for strict scheduling.
+func priorityWeights(config *Config) ([]int, error) {
+	switch config.scheduling {
+	case schedulingStrict:
+		return nil, nil
+	case schedulingWeighted:
+		const numPriorities = 3
+
+		if len(config.priorityWeights) != numPriorities || slices.Min(config.priorityWeights) < 1 {
+			return nil, fmt.Errorf("%w: --priority-weights needs three positive numbers", ErrInvalidScheduling)
+		}
+
+		return config.priorityWeights, nil
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrInvalidScheduling, config.scheduling)
+	}
+}
+
+const (
+	moderationOff      = "off"
+	moderationProvider = "provider"
+)
+
+var ErrInvalidModeration = errors.New("invalid moderation")
+
+// newModerator returns nil, meaning nothing is reviewed, unless --moderation or --moderation-words is set. The word
+// list is checked first since it costs nothing.
+func newModerator(config *Config, gen server.Provider) (server.Moderator, error) {
+	var moderators []server.Moderator
+
+	if config.moderationWords != "" {
+		v, err := os.ReadFile(config.moderationWords)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read --moderation-words: %w", err)
+		}
+
+		moderators = append(moderators, server.NewWordListModerator(strings.Fields(string(v))))
+	}
+
+	switch config.moderation {
+	case moderationOff:
+	case moderationProvider:
+		moderators = append(moderators, server.NewProviderModerator(gen))
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrInvalidModeration, config.moderation)
+	}
+
+	if len(moderators) == 0 {
+		return nil, nil //nolint:nilnil // nil means nothing is reviewed
+	}
+
+	return server.Moderators(moderators...), nil
+}
+
+var ErrInvalidTrustedProxy = errors.New("invalid --trusted-proxy, expected an IP or CIDR")
+
+func parseTrustedProxies(v []string) ([]netip.Prefix, error) {
+	trusted := make([]netip.Prefix, 0, len(v))
+
+	for _, vv := range v {
+		p, err := netip.ParsePrefix(vv)
+		if err != nil {
+			addr, addrErr := netip.ParseAddr(vv)
+			if addrErr != nil {
+				return nil, fmt.Errorf("%w: %s", ErrInvalidTrustedProxy, vv)
+			}
+
+			p = netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen())
+		}
+
+		trusted = append(trusted, p.Masked())
+	}
+
+	return trusted, nil
+}
+
+// newRateLimiter returns nil, meaning no limit, unless --rate-limit is set.
+func newRateLimiter(config *Config, trusted []netip.Prefix) server.RateLimiter {
+	if config.ratePerMinute <= 0 {
+		return nil
+	}
+
+	const secondsPerMinute = 60
+
+	return server.NewTokenBucketLimiter(config.ratePerMinute/secondsPerMinute, max(1, config.rateBurst), trusted)
+}
+
+var ErrInvalidSiteBudget = errors.New("invalid --site-budget, expected SITE=TOKENS:IMAGES")
+
+func parseSiteBudgets(v []string) (map[string]server.Limits, error) {
+	result := make(map[string]server.Limits, len(v))
+
+	for _, vv := range v {
+		site, limits, ok := strings.Cut(vv, "=")
+		if !ok {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidSiteBudget, vv)
+		}
+
+		tokens, images, ok := strings.Cut(limits, ":")
+		if !ok {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidSiteBudget, vv)
+		}
+
+		var l server.Limits
+
+		_, err := fmt.Sscan(tokens+" "+images, &l.Tokens, &l.Images)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidSiteBudget, vv)
+		}
+
+		result[site] = l
+	}
+
+	return result, nil
+}
+
+// handleBudgetExhausted serves budget.html as a temporary failure that clients should retry after midnight UTC.
+func handleBudgetExhausted(w http.ResponseWriter, root *os.Root) {
+	content, err := getStaticFile("budget.html", root)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	now := time.Now().UTC()
+	midnight := now.Truncate(24 * time.Hour).Add(24 * time.Hour) //nolint:mnd // a day
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Retry-After", strconv.Itoa(int(midnight.Sub(now).Seconds())))
+	w.WriteHeader(http.StatusServiceUnavailable)
+
+	_, _ = w.Write(content)
 }
 
 func handleStaticFile(w http.ResponseWriter, filename, contentType string, root *os.Root) {
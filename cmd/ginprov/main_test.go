@@ -0,0 +1,207 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"regexp"
+	"slices"
+	"sync"
+	"testing"
+
+	"github.com/jasonthorsness/ginprov/fake"
+	"github.com/jasonthorsness/ginprov/generation"
+	"github.com/jasonthorsness/ginprov/metrics"
+	"github.com/jasonthorsness/ginprov/server"
+	"github.com/spf13/cobra"
+)
+
+// parseConfig parses args the way ginprov would, without running the server.
+func parseConfig(t *testing.T, args ...string) *Config {
+	t.Helper()
+
+	var parsed *Config
+
+	cmd := createRootCmd(func(_ *cobra.Command, _ []string, config *Config) error {
+		parsed = config
+		return nil
+	})
+	cmd.SetArgs(args)
+
+	err := cmd.Execute()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return parsed
+}
+
+// newTestHandler returns the handler runServer would serve for a temporary content directory, with the fake
+// provider.
+func newTestHandler(t *testing.T) (http.HandlerFunc, *os.Root) {
+	t.Helper()
+
+	config := parseConfig(t, "--provider=fake")
+	dir := t.TempDir()
+
+	root, err := os.OpenRoot(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { _ = root.Close() })
+
+	budget, err := server.NewDailyBudget(root, dir, config.globalLimits, config.siteLimits, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool := server.NewWorkerPool(1, 1, nil, server.GroupLimits{Workers: 0, Queued: 0})
+	t.Cleanup(func() { _ = pool.Close() })
+
+	m := server.NewMetrics(metrics.NewRegistry(), pool)
+
+	var mu sync.Mutex
+
+	handler := createHTTPHandler(config, regexp.MustCompile(`[^a-z0-9]`), root, dir, fake.New(0, config.defaults),
+		pool, budget, nil, nil, m, make(map[string]*server.Server), &mu)
+
+	return handler, root
+}
+
+// get serves a GET for path with handler.
+func get(handler http.HandlerFunc, path string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest(http.MethodGet, path, nil))
+
+	return w
+}
+
+func TestIsPrefix(t *testing.T) {
+	t.Parallel()
+
+	prefixRe := regexp.MustCompile(`[^a-z0-9]`)
+
+	tests := []struct {
+		v        string
+		expected bool
+	}{
+		{"plain", true},
+		{"my-site", true},
+		{"site-2", true},
+		{"", false},
+		{"My-Site", false},
+		{"-site", false},
+		{"site-", false},
+		{"my_site", false},
+		{"my.site", false},
+		{"..", false},
+		{"a-very-long-site-name-that-goes-on-and-on", false},
+	}
+
+	for _, tt := range tests {
+		if got := isPrefix(prefixRe, tt.v); got != tt.expected {
+			t.Errorf("isPrefix(%q) = %v, expected %v", tt.v, got, tt.expected)
+		}
+	}
+}
+
+func TestGenerationDefaults(t *testing.T) {
+	t.Parallel()
+
+	zero := float32(0)
+	half := float32(0.5)
+	seed := int32(7)
+
+	tests := []struct {
+		name     string
+		args     []string
+		expected generation.Defaults
+	}{
+		{"nothing set", nil, generation.Defaults{}},
+		{
+			"models",
+			[]string{"--text-model=t", "--image-model=i"},
+			generation.Defaults{Text: generation.Options{Model: "t"}, Image: generation.Options{Model: "i"}},
+		},
+		{
+			"deprecated openai model flags",
+			[]string{"--openai-text-model=t", "--openai-image-model=i"},
+			generation.Defaults{Text: generation.Options{Model: "t"}, Image: generation.Options{Model: "i"}},
+		},
+		{
+			"zero temperature is set",
+			[]string{"--temperature=0"},
+			generation.Defaults{Text: generation.Options{Temperature: &zero}},
+		},
+		{
+			"text parameters",
+			[]string{"--temperature=0.5", "--top-p=0.5", "--max-output-tokens=100"},
+			generation.Defaults{Text: generation.Options{Temperature: &half, TopP: &half, MaxOutputTokens: 100}},
+		},
+		{
+			"seed applies to both",
+			[]string{"--seed=7"},
+			generation.Defaults{Text: generation.Options{Seed: &seed}, Image: generation.Options{Seed: &seed}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			config := parseConfig(t, tt.args...)
+			if !reflect.DeepEqual(config.defaults, tt.expected) {
+				t.Errorf("expected %+v, got %+v", tt.expected, config.defaults)
+			}
+		})
+	}
+}
+
+func TestNewPolicy(t *testing.T) {
+	t.Parallel()
+
+	policy, err := newPolicy(parseConfig(t,
+		"--allow-element=Video=SRC,controls", "--allow-element=canvas", "--allow-element=p=translate",
+		"--allow-attribute=itemprop", "--drop-element=table,form", "--drop-element=canvas"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v, ok := policy.Elements["video"]; !ok || !reflect.DeepEqual(v, []string{"src", "controls"}) {
+		t.Errorf("expected video with src and controls, got %v, %v", v, ok)
+	}
+
+	if v := policy.Elements["p"]; !reflect.DeepEqual(v, []string{"translate"}) {
+		t.Errorf("expected p with translate, got %v", v)
+	}
+
+	if slices.Contains(policy.Drop, "video") {
+		t.Error("expected video not to be dropped once allowed")
+	}
+
+	if !slices.Contains(policy.Attributes, "itemprop") || !slices.Contains(policy.Attributes, "class") {
+		t.Errorf("expected itemprop added to the default attributes, got %v", policy.Attributes)
+	}
+
+	for _, name := range []string{"table", "form", "canvas"} {
+		if _, ok := policy.Elements[name]; ok || !slices.Contains(policy.Drop, name) {
+			t.Errorf("expected %s to be dropped", name)
+		}
+	}
+
+	for _, args := range [][]string{
+		{"--allow-element="},
+		{"--allow-element==src"},
+		{"--allow-element=video=src,,controls"},
+		{"--allow-attribute=itemprop,,itemscope"},
+		{"--drop-element=table,,form"},
+	} {
+		_, err = newPolicy(parseConfig(t, args...))
+		if !errors.Is(err, ErrInvalidPolicy) {
+			t.Errorf("expected ErrInvalidPolicy for %v, got %v", args, err)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+
+	"github.com/jasonthorsness/ginprov/server"
+)
+
+// handleStatusAPI reports on a slug without generating it. Sites that do not exist yet are not created.
+func handleStatusAPI(
+	w http.ResponseWriter,
+	root *os.Root,
+	prefix string,
+	slug string,
+	serverFor func(prefix string) (*server.Server, error),
+) {
+	stat, err := root.Stat(prefix)
+	if err != nil || !stat.IsDir() {
+		http.Error(w, "Site not found", http.StatusNotFound)
+		return
+	}
+
+	s, err := serverFor(prefix)
+	if err != nil {
+		http.Error(w, "Failed to open site", http.StatusInternalServerError)
+		return
+	}
+
+	status, err := s.Status(slug)
+	if err != nil {
+		if errors.Is(err, server.ErrNotFound) {
+			http.Error(w, "Page not found", http.StatusNotFound)
+			return
+		}
+
+		http.Error(w, "Failed to get status", http.StatusInternalServerError)
+
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+
+	err = json.NewEncoder(w).Encode(status)
+	if err != nil {
+		http.Error(w, "Failed to encode status", http.StatusInternalServerError)
+		return
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/jasonthorsness/ginprov/server"
+)
+
+func TestStatusAPI(t *testing.T) {
+	t.Parallel()
+
+	handler, root := newTestHandler(t)
+
+	err := root.Mkdir("my-site", 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := get(handler, "/api/status/my-site/index.html")
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200 for a hyphenated site, got %d %q", w.Code, w.Body.String())
+	}
+
+	var status server.Status
+
+	err = json.Unmarshal(w.Body.Bytes(), &status)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if status.Exists || status.Pending {
+		t.Errorf("expected nothing generated yet, got %+v", status)
+	}
+
+	for _, path := range []string{
+		"/api/status/other-site/index.html",
+		"/api/status/My-Site/index.html",
+		"/api/status/my-site-/index.html",
+		"/api/status//index.html",
+	} {
+		w = get(handler, path)
+		if w.Code != http.StatusNotFound {
+			t.Errorf("expected 404 for %s, got %d", path, w.Code)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/jasonthorsness/ginprov/generation"
+	"github.com/jasonthorsness/ginprov/server"
+)
+
+// Pricing converts usage to an estimated cost in whatever currency the rates are given in.
+type Pricing struct {
+	InputPerMillion  float64
+	OutputPerMillion float64
+	PerImage         float64
+}
+
+func (p Pricing) cost(u generation.Usage) float64 {
+	const million = 1_000_000
+
+	return float64(u.InputTokens)*p.InputPerMillion/million +
+		float64(u.OutputTokens)*p.OutputPerMillion/million +
+		float64(u.Images)*p.PerImage
+}
+
+type UsageReport struct {
+	Slug string `json:"slug,omitempty"`
+	generation.Usage
+	Cost float64 `json:"cost"`
+}
+
+type SitesUsage struct {
+	Total UsageReport   `json:"total"`
+	Sites []UsageReport `json:"sites"`
+}
+
+type SiteUsage struct {
+	Total UsageReport   `json:"total"`
+	Pages []UsageReport `json:"pages"`
+}
+
+func handleUsageAPI(w http.ResponseWriter, root *os.Root, pricing Pricing) {
+	f, err := root.Open(".")
+	if err != nil {
+		http.Error(w, "Failed to open content directory", http.StatusInternalServerError)
+		return
+	}
+
+	dirs, err := f.ReadDir(0)
+	_ = f.Close()
+
+	if err != nil {
+		http.Error(w, "Failed to read content directory", http.StatusInternalServerError)
+		return
+	}
+
+	var total generation.Usage
+
+	sites := make([]UsageReport, 0, len(dirs))
+
+	for _, dir := range dirs {
+		if !dir.IsDir() {
+			continue
+		}
+
+		slug := dir.Name()
+
+		u, err := server.ReadUsage(root, slug+"/"+server.UsageJSON)
+		if err != nil || u == (generation.Usage{}) {
+			continue
+		}
+
+		total.Add(u)
+
+		sites = append(sites, UsageReport{slug, u, pricing.cost(u)})
+	}
+
+	sortUsageReports(sites)
+
+	writeUsageJSON(w, SitesUsage{UsageReport{"", total, pricing.cost(total)}, sites})
+}
+
+func handleSiteUsageAPI(w http.ResponseWriter, root *os.Root, prefix string, pricing Pricing) {
+	rr, err := root.OpenRoot(prefix)
+	if err != nil {
+		http.Error(w, "Site not found", http.StatusNotFound)
+		return
+	}
+
+	defer func() {
+		_ = rr.Close() // read only
+	}()
+
+	total, err := server.ReadUsage(rr, server.UsageJSON)
+	if err != nil {
+		http.Error(w, "Failed to read site usage", http.StatusInternalServerError)
+		return
+	}
+
+	f, err := rr.Open(".")
+	if err != nil {
+		http.Error(w, "Failed to open site directory", http.StatusInternalServerError)
+		return
+	}
+
+	entries, err := f.ReadDir(0)
+	_ = f.Close()
+
+	if err != nil {
+		http.Error(w, "Failed to read site directory", http.StatusInternalServerError)
+		return
+	}
+
+	pages := make([]UsageReport, 0, len(entries))
+
+	for _, entry := range entries {
+		slug, ok := strings.CutSuffix(entry.Name(), server.ExtensionUsage)
+		if !ok || entry.IsDir() {
+			continue
+		}
+
+		u, err := server.ReadUsage(rr, entry.Name())
+		if err != nil {
+			continue
+		}
+
+		pages = append(pages, UsageReport{slug, u, pricing.cost(u)})
+	}
+
+	sortUsageReports(pages)
+
+	writeUsageJSON(w, SiteUsage{UsageReport{prefix, total, pricing.cost(total)}, pages})
+}
+
+func sortUsageReports(v []UsageReport) {
+	sort.Slice(v, func(i, j int) bool {
+		a := v[i].InputTokens + v[i].OutputTokens
+		b := v[j].InputTokens + v[j].OutputTokens
+
+		if a != b {
+			return a > b
+		}
+
+		return v[i].Slug < v[j].Slug
+	})
+}
+
+func writeUsageJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		http.Error(w, "Failed to encode usage", http.StatusInternalServerError)
+		return
+	}
+}
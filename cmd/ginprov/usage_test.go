@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jasonthorsness/ginprov/generation"
+	"github.com/jasonthorsness/ginprov/server"
+)
+
+func TestUsageAPI(t *testing.T) {
+	t.Parallel()
+
+	handler, root := newTestHandler(t)
+
+	usage := generation.Usage{InputTokens: 10, OutputTokens: 20, Images: 1}
+
+	v, err := json.Marshal(usage)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = root.Mkdir("my-site", 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"my-site/" + server.UsageJSON, "my-site/index.html" + server.ExtensionUsage} {
+		err = os.WriteFile(filepath.Join(root.Name(), name), v, 0o600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	w := get(handler, "/api/usage")
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d %q", w.Code, w.Body.String())
+	}
+
+	var sites SitesUsage
+
+	err = json.Unmarshal(w.Body.Bytes(), &sites)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(sites.Sites) != 1 || sites.Sites[0].Slug != "my-site" || sites.Total.Usage != usage {
+		t.Errorf("unexpected usage %+v", sites)
+	}
+
+	w = get(handler, "/api/usage/my-site")
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200 for a hyphenated site, got %d %q", w.Code, w.Body.String())
+	}
+
+	var site SiteUsage
+
+	err = json.Unmarshal(w.Body.Bytes(), &site)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(site.Pages) != 1 || site.Pages[0].Slug != "index.html" || site.Total.Usage != usage {
+		t.Errorf("unexpected site usage %+v", site)
+	}
+
+	for _, path := range []string{"/api/usage/other-site", "/api/usage/My-Site", "/api/usage/my-site-", "/api/usage/"} {
+		w = get(handler, path)
+		if w.Code != http.StatusNotFound {
+			t.Errorf("expected 404 for %s, got %d", path, w.Code)
+		}
+	}
+}
@@ -0,0 +1,295 @@
+package fake
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"hash/fnv"
+	"image"
+	"image/color"
+	"image/png"
+	"math/rand/v2"
+	"strings"
+	"time"
+
+	"github.com/jasonthorsness/ginprov/generation"
+	"golang.org/x/net/html"
+)
+
+// Client is an offline stand-in for gemini.Client. Output is deterministic for a given prompt so the server can be
+// exercised end to end without network access or an API key.
+type Client struct {
+	defaults generation.Defaults
+	delay    time.Duration
+}
+
+// New returns a fake client that sleeps for delay between streamed chunks, which can be zero. Only the seed in
+// defaults and options has any effect.
+func New(delay time.Duration, defaults generation.Defaults) *Client {
+	return &Client{defaults, delay}
+}
+
+func (c *Client) Close() error {
+	return nil
+}
+
+const chunkSize = 64
+
+func (c *Client) HTML(
+	ctx context.Context,
+	prompt string,
+	options generation.Options,
+	progress func(string),
+) (*html.Node, error) {
+	r := newRand(prompt, c.defaults.Text.Merge(options))
+
+	raw := page(r)
+
+	reportUsage(ctx, prompt, raw, 0)
+
+	err := c.stream(ctx, raw, progress)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := html.Parse(strings.NewReader(raw))
+	if err != nil {
+		return nil, fmt.Errorf("html.Parse failed: %w", err)
+	}
+
+	return result, nil
+}
+
+func (c *Client) PNG(
+	ctx context.Context,
+	prompt string,
+	options generation.Options,
+	progress func(string),
+) ([]byte, error) {
+	r := newRand(prompt, c.defaults.Image.Merge(options))
+
+	err := c.stream(ctx, "Painting "+phrase(r, 3)+"...\n", progress)
+	if err != nil {
+		return nil, err
+	}
+
+	reportUsage(ctx, prompt, "", 1)
+
+	const width, height = 256, 192
+
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+
+	from := randomColor(r)
+	to := randomColor(r)
+	stripes := 2 + r.IntN(8)
+
+	for y := range height {
+		for x := range width {
+			t := float64(x+y) / float64(width+height)
+			c := lerp(from, to, t)
+
+			if (x*stripes/width)%2 == 0 {
+				c.R /= 2
+			}
+
+			img.Set(x, y, c)
+		}
+	}
+
+	var buf bytes.Buffer
+
+	err = png.Encode(&buf, img)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode PNG: %w", err)
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (c *Client) Text(
+	ctx context.Context,
+	prompt string,
+	options generation.Options,
+	progress func(string),
+) (string, error) {
+	// everything is safe
+	if strings.Contains(prompt, generation.SafetyRequest) {
+		reportUsage(ctx, prompt, generation.Safe, 0)
+		return generation.Safe, c.stream(ctx, generation.Safe, progress)
+	}
+
+	r := newRand(prompt, c.defaults.Text.Merge(options))
+
+	var sb strings.Builder
+
+	sb.WriteString("# " + title(phrase(r, 3)) + "\n\n")
+	sb.WriteString(sentence(r) + "\n\n")
+	sb.WriteString("## Site map\n\n")
+
+	const pages = 5
+
+	for range pages {
+		sb.WriteString("- " + slug(r, ".html") + "\n")
+	}
+
+	result := sb.String()
+
+	reportUsage(ctx, prompt, result, 0)
+
+	return result, c.stream(ctx, result, progress)
+}
+
+// Vision ignores the image. Like Text, it calls everything safe when asked.
+func (c *Client) Vision(ctx context.Context, prompt string, _ []byte, options generation.Options) (string, error) {
+	result := generation.Safe
+	if !strings.Contains(prompt, generation.SafetyRequest) {
+		result = sentence(newRand(prompt, c.defaults.Text.Merge(options)))
+	}
+
+	reportUsage(ctx, prompt, result, 0)
+
+	return result, c.stream(ctx, result, nil)
+}
+
+func (c *Client) stream(ctx context.Context, v string, progress func(string)) error {
+	for len(v) > 0 {
+		n := min(chunkSize, len(v))
+
+		if c.delay > 0 {
+			select {
+			case <-ctx.Done():
+				return fmt.Errorf("fake stream interrupted: %w", ctx.Err())
+			case <-time.After(c.delay):
+			}
+		}
+
+		if progress != nil {
+			progress(v[:n])
+		}
+
+		v = v[n:]
+	}
+
+	return nil
+}
+
+// reportUsage approximates the token counts of a real model at about four bytes per token.
+func reportUsage(ctx context.Context, prompt, output string, images int64) {
+	const bytesPerToken = 4
+
+	generation.ReportUsage(ctx, generation.Usage{
+		InputTokens:  int64(len(prompt) / bytesPerToken),
+		OutputTokens: int64(len(output) / bytesPerToken),
+		Images:       images,
+	})
+}
+
+func page(r *rand.Rand) string {
+	name := title(phrase(r, 2))
+	hero := slug(r, ".jpg")
+
+	var sb strings.Builder
+
+	sb.WriteString("<!DOCTYPE html>\n<html>\n<head>\n<meta charset=\"utf-8\">\n")
+	sb.WriteString("<title>" + name + "</title>\n")
+	sb.WriteString("<style>\n")
+	sb.WriteString("body { font-family: sans-serif; margin: 0; color: #222; }\n")
+	sb.WriteString(".hero { height: 240px; background: url('" + hero + "') center / cover; }\n")
+	sb.WriteString("main { max-width: 60rem; margin: 0 auto; padding: 1rem; }\n")
+	sb.WriteString("img { object-fit: cover; }\n")
+	sb.WriteString("</style>\n</head>\n<body>\n")
+	sb.WriteString("<div class=\"hero\"></div>\n<main>\n")
+	sb.WriteString("<h1>" + name + "</h1>\n")
+
+	const sections = 3
+
+	for range sections {
+		sb.WriteString("<h2>" + title(phrase(r, 3)) + "</h2>\n")
+		sb.WriteString("<p>" + sentence(r) + " " + sentence(r) + "</p>\n")
+		sb.WriteString(fmt.Sprintf("<img src=\"%s\" width=\"320\" height=\"240\" alt=\"%s\">\n",
+			slug(r, ".jpg"), phrase(r, 2)))
+	}
+
+	sb.WriteString("<nav>\n<ul>\n")
+	sb.WriteString("<li><a href=\"/\">Home</a></li>\n")
+
+	const links = 4
+
+	for range links {
+		v := slug(r, ".html")
+		sb.WriteString("<li><a href=\"" + v + "\">" + title(strings.ReplaceAll(v[:len(v)-len(".html")], "-", " ")) +
+			"</a></li>\n")
+	}
+
+	sb.WriteString("</ul>\n</nav>\n</main>\n</body>\n</html>\n")
+
+	return sb.String()
+}
+
+//nolint:gochecknoglobals
+var words = []string{
+	"amber", "anchor", "aurora", "basil", "beacon", "birch", "breeze", "canyon", "cedar", "comet",
+	"copper", "coral", "cricket", "dune", "ember", "fable", "fern", "fjord", "garden", "glacier",
+	"harbor", "hazel", "heron", "island", "ivy", "juniper", "kettle", "lagoon", "lantern", "maple",
+	"meadow", "mesa", "nectar", "orchard", "otter", "pebble", "pine", "quartz", "quill", "raven",
+	"reef", "river", "saffron", "sparrow", "summit", "thistle", "tide", "tundra", "valley", "willow",
+}
+
+// newRand seeds a generator from the prompt, mixing in the seed option so changing it varies the output.
+func newRand(prompt string, options generation.Options) *rand.Rand {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(prompt))
+	seed := h.Sum64()
+
+	if options.Seed != nil {
+		seed ^= uint64(*options.Seed)
+	}
+
+	return rand.New(rand.NewPCG(seed, seed>>1)) //nolint:gosec // deterministic output is the point
+}
+
+func phrase(r *rand.Rand, n int) string {
+	v := make([]string, n)
+	for i := range v {
+		v[i] = words[r.IntN(len(words))]
+	}
+
+	return strings.Join(v, " ")
+}
+
+func slug(r *rand.Rand, ext string) string {
+	const minWords, extraWords = 2, 3
+
+	return strings.ReplaceAll(phrase(r, minWords+r.IntN(extraWords)), " ", "-") + ext
+}
+
+func title(v string) string {
+	parts := strings.Fields(v)
+	for i, p := range parts {
+		parts[i] = strings.ToUpper(p[:1]) + p[1:]
+	}
+
+	return strings.Join(parts, " ")
+}
+
+func sentence(r *rand.Rand) string {
+	const minWords, extraWords = 6, 8
+
+	v := phrase(r, minWords+r.IntN(extraWords))
+
+	return strings.ToUpper(v[:1]) + v[1:] + "."
+}
+
+func randomColor(r *rand.Rand) color.RGBA {
+	const maxUint8 = 256
+
+	return color.RGBA{uint8(r.IntN(maxUint8)), uint8(r.IntN(maxUint8)), uint8(r.IntN(maxUint8)), 0xff}
+}
+
+func lerp(a, b color.RGBA, t float64) color.RGBA {
+	mix := func(x, y uint8) uint8 {
+		return uint8(float64(x) + (float64(y)-float64(x))*t)
+	}
+
+	return color.RGBA{mix(a.R, b.R), mix(a.G, b.G), mix(a.B, b.B), 0xff}
+}
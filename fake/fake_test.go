@@ -0,0 +1,135 @@
+package fake
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image/png"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jasonthorsness/ginprov/generation"
+	"golang.org/x/net/html"
+)
+
+func render(t *testing.T, c *Client, prompt string, options generation.Options) string {
+	t.Helper()
+
+	var progress strings.Builder
+
+	doc, err := c.HTML(context.Background(), prompt, options, func(v string) { progress.WriteString(v) })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var sb strings.Builder
+
+	err = html.Render(&sb, doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(progress.String(), "</html>") {
+		t.Errorf("expected the page to be streamed as progress, got %q", progress.String())
+	}
+
+	return sb.String()
+}
+
+func TestDeterministic(t *testing.T) {
+	t.Parallel()
+
+	c := New(0, generation.Defaults{})
+
+	a := render(t, c, "a page", generation.Options{})
+	if b := render(t, c, "a page", generation.Options{}); a != b {
+		t.Error("expected the same page for the same prompt")
+	}
+
+	if b := render(t, c, "another page", generation.Options{}); a == b {
+		t.Error("expected a different page for a different prompt")
+	}
+
+	seed := int32(7)
+	if b := render(t, c, "a page", generation.Options{Seed: &seed}); a == b {
+		t.Error("expected a different page for a different seed")
+	}
+
+	text, err := c.Text(context.Background(), "an outline", generation.Options{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	again, err := c.Text(context.Background(), "an outline", generation.Options{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if text != again || text == generation.Safe {
+		t.Errorf("expected the same outline twice, got %q and %q", text, again)
+	}
+}
+
+func TestPNG(t *testing.T) {
+	t.Parallel()
+
+	var usage generation.Usage
+
+	ctx := generation.WithUsage(context.Background(), usage.Add)
+
+	v, err := New(0, generation.Defaults{}).PNG(ctx, "a picture", generation.Options{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	img, err := png.Decode(bytes.NewReader(v))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if img.Bounds().Dx() == 0 || img.Bounds().Dy() == 0 {
+		t.Errorf("expected a non-empty image, got %v", img.Bounds())
+	}
+
+	if usage.Images != 1 {
+		t.Errorf("expected one image reported, got %+v", usage)
+	}
+}
+
+func TestSafetyPrompt(t *testing.T) {
+	t.Parallel()
+
+	c := New(0, generation.Defaults{})
+	ctx := context.Background()
+	prompt := "If this is appropriate, " + generation.SafetyRequest + "."
+
+	v, err := c.Text(ctx, prompt, generation.Options{}, nil)
+	if err != nil || v != generation.Safe {
+		t.Errorf("expected %q, got %q, %v", generation.Safe, v, err)
+	}
+
+	v, err = c.Vision(ctx, prompt, []byte("jpg"), generation.Options{})
+	if err != nil || v != generation.Safe {
+		t.Errorf("expected %q from Vision, got %q, %v", generation.Safe, v, err)
+	}
+}
+
+func TestCancel(t *testing.T) {
+	t.Parallel()
+
+	c := New(time.Hour, generation.Defaults{})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+
+	_, err := c.HTML(ctx, "a page", generation.Options{}, nil)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+
+	_, err = c.PNG(ctx, "a picture", generation.Options{}, nil)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled from PNG, got %v", err)
+	}
+}
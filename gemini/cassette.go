@@ -0,0 +1,276 @@
+package gemini
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"iter"
+	"os"
+	"sync"
+	"time"
+
+	"google.golang.org/genai"
+)
+
+var (
+	ErrCassetteMiss = errors.New("no recorded response in cassette")
+	ErrReplayed     = errors.New("replayed error")
+)
+
+// cassetteEntry is one recorded GenerateContentStream call. A cassette file holds one JSON-encoded entry per line.
+// Config holds the generation options and Image the SHA-256 of an attached image, which is all matching needs.
+// Entries recorded before Config was kept match any options.
+type cassetteEntry struct {
+	Model  string          `json:"model"`
+	Prompt string          `json:"prompt"`
+	Config json.RawMessage `json:"config,omitempty"`
+	Image  string          `json:"image,omitempty"`
+	Chunks []cassetteChunk `json:"chunks"`
+}
+
+func (e *cassetteEntry) key() string {
+	return cassetteKey(e.Model, e.Prompt, e.Config, e.Image)
+}
+
+// cassetteChunk is a single streamed response, or error, along with its offset from the start of the call. Errors
+// from the API are kept whole in APIError so a replayed error is retried exactly when the live one was.
+type cassetteChunk struct {
+	Response *genai.GenerateContentResponse `json:"response,omitempty"`
+	APIError *genai.APIError                `json:"apiError,omitempty"`
+	Error    string                         `json:"error,omitempty"`
+	Offset   time.Duration                  `json:"offset"`
+}
+
+// err returns the recorded error, wrapped in ErrReplayed, or nil.
+func (c *cassetteChunk) err() error {
+	switch {
+	case c.APIError != nil:
+		return fmt.Errorf("%w: %w", ErrReplayed, *c.APIError)
+	case c.Error != "":
+		return fmt.Errorf("%w: %s", ErrReplayed, c.Error)
+	default:
+		return nil
+	}
+}
+
+type recorder struct {
+	inner streamFunc
+	f     *os.File
+	err   error
+	mu    sync.Mutex
+}
+
+func newRecorder(inner streamFunc, path string) (*recorder, error) {
+	const cassettePermissions = 0o644
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY|os.O_CREATE, cassettePermissions)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open cassette %s: %w", path, err)
+	}
+
+	return &recorder{inner, f, nil, sync.Mutex{}}, nil
+}
+
+func (r *recorder) stream(
+	ctx context.Context,
+	model string,
+	prompt string,
+	image []byte,
+	config *genai.GenerateContentConfig,
+) iter.Seq2[*genai.GenerateContentResponse, error] {
+	return func(yield func(*genai.GenerateContentResponse, error) bool) {
+		entry := &cassetteEntry{model, prompt, configJSON(config), imageDigest(image), nil}
+		start := time.Now()
+
+		defer r.write(entry)
+
+		for chunk, err := range r.inner(ctx, model, prompt, image, config) {
+			c := cassetteChunk{chunk, nil, "", time.Since(start)}
+			if err != nil {
+				c.Error = err.Error()
+
+				var apiErr genai.APIError
+				if errors.As(err, &apiErr) {
+					c.APIError = &apiErr
+				}
+			}
+
+			entry.Chunks = append(entry.Chunks, c)
+
+			if !yield(chunk, err) {
+				return
+			}
+		}
+	}
+}
+
+func (r *recorder) write(entry *cassetteEntry) {
+	v, err := json.Marshal(entry)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err != nil {
+		r.err = errors.Join(r.err, fmt.Errorf("failed to encode cassette entry: %w", err))
+		return
+	}
+
+	_, err = r.f.Write(append(v, '\n'))
+	if err != nil {
+		r.err = errors.Join(r.err, fmt.Errorf("failed to write cassette entry: %w", err))
+	}
+}
+
+// Close closes the cassette file and reports any error encountered while recording.
+func (r *recorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	err := r.f.Close()
+	if err != nil {
+		return errors.Join(r.err, fmt.Errorf("failed to close cassette: %w", err))
+	}
+
+	return r.err
+}
+
+type replayer struct {
+	entries map[string][]*cassetteEntry
+	mu      sync.Mutex
+}
+
+func newReplayer(path string) (*replayer, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open cassette %s: %w", path, err)
+	}
+
+	defer func() {
+		_ = f.Close() // read only
+	}()
+
+	r := &replayer{make(map[string][]*cassetteEntry), sync.Mutex{}}
+
+	const maxEntrySize = 64 << 20
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, maxEntrySize)
+
+	for scanner.Scan() {
+		var entry cassetteEntry
+
+		err = json.Unmarshal(scanner.Bytes(), &entry)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode cassette %s: %w", path, err)
+		}
+
+		key := entry.key()
+		r.entries[key] = append(r.entries[key], &entry)
+	}
+
+	err = scanner.Err()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cassette %s: %w", path, err)
+	}
+
+	return r, nil
+}
+
+// next returns recorded entries for the first of keys with any, in the order they were recorded; the last is
+// repeated once exhausted.
+func (r *replayer) next(keys ...string) (*cassetteEntry, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, key := range keys {
+		entries := r.entries[key]
+		if len(entries) == 0 {
+			continue
+		}
+
+		if len(entries) > 1 {
+			r.entries[key] = entries[1:]
+		}
+
+		return entries[0], true
+	}
+
+	return nil, false
+}
+
+func (r *replayer) stream(
+	ctx context.Context,
+	model string,
+	prompt string,
+	image []byte,
+	config *genai.GenerateContentConfig,
+) iter.Seq2[*genai.GenerateContentResponse, error] {
+	return func(yield func(*genai.GenerateContentResponse, error) bool) {
+		digest := imageDigest(image)
+		entry, ok := r.next(
+			cassetteKey(model, prompt, configJSON(config), digest),
+			cassetteKey(model, prompt, nil, digest))
+		if !ok {
+			yield(nil, fmt.Errorf("%w: model %s, prompt %.40q", ErrCassetteMiss, model, prompt))
+			return
+		}
+
+		start := time.Now()
+
+		for _, c := range entry.Chunks {
+			wait := c.Offset - time.Since(start)
+			if wait > 0 {
+				timer := time.NewTimer(wait)
+
+				select {
+				case <-ctx.Done():
+					timer.Stop()
+					yield(nil, ctx.Err())
+
+					return
+				case <-timer.C:
+				}
+			}
+
+			if !yield(c.Response, c.err()) {
+				return
+			}
+		}
+	}
+}
+
+func (r *replayer) Close() error {
+	return nil
+}
+
+func cassetteKey(model, prompt string, config json.RawMessage, image string) string {
+	return model + "\x00" + prompt + "\x00" + string(config) + "\x00" + image
+}
+
+// configJSON returns config in the form it is recorded.
+func configJSON(config *genai.GenerateContentConfig) json.RawMessage {
+	if config == nil {
+		return nil
+	}
+
+	v, err := json.Marshal(config)
+	if err != nil {
+		return nil // plain data always encodes
+	}
+
+	return v
+}
+
+func imageDigest(image []byte) string {
+	if image == nil {
+		return ""
+	}
+
+	v := sha256.Sum256(image)
+
+	return hex.EncodeToString(v[:])
+}
@@ -0,0 +1,215 @@
+package gemini
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"iter"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jasonthorsness/ginprov/generation"
+	"google.golang.org/genai"
+)
+
+func textChunk(v string) *genai.GenerateContentResponse {
+	return &genai.GenerateContentResponse{
+		Candidates: []*genai.Candidate{{Content: &genai.Content{Parts: []*genai.Part{{Text: v}}, Role: "model"}}},
+	}
+}
+
+func TestCassetteRecordReplay(t *testing.T) {
+	t.Parallel()
+
+	const delay = 20 * time.Millisecond
+
+	var live streamFunc = func(
+		_ context.Context,
+		_ string,
+		_ string,
+		_ []byte,
+		_ *genai.GenerateContentConfig,
+	) iter.Seq2[*genai.GenerateContentResponse, error] {
+		return func(yield func(*genai.GenerateContentResponse, error) bool) {
+			for _, v := range []string{"<html><body>", "hello", "</body></html>"} {
+				time.Sleep(delay)
+
+				if !yield(textChunk(v), nil) {
+					return
+				}
+			}
+		}
+	}
+
+	path := filepath.Join(t.TempDir(), "cassette.jsonl")
+
+	r, err := newRecorder(live, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recording := &Client{r.stream, nil, r, withDefaultModels(generation.Defaults{}), DefaultRetryPolicy()}
+
+	var recorded []string
+
+	record := func(v string) { recorded = append(recorded, v) }
+
+	_, err = recording.HTML(context.Background(), "a page", generation.Options{}, record)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = recording.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	replaying, err := NewReplaying(path, generation.Defaults{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var replayed []string
+
+	replay := func(v string) { replayed = append(replayed, v) }
+
+	start := time.Now()
+
+	_, err = replaying.HTML(context.Background(), "a page", generation.Options{}, replay)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if time.Since(start) < 3*delay {
+		t.Errorf("replay did not preserve timing, took %v", time.Since(start))
+	}
+
+	if strings.Join(replayed, "|") != strings.Join(recorded, "|") {
+		t.Errorf("expected %q, got %q", recorded, replayed)
+	}
+
+	_, err = replaying.HTML(context.Background(), "another page", generation.Options{}, nil)
+	if !errors.Is(err, ErrCassetteMiss) {
+		t.Errorf("expected ErrCassetteMiss, got %v", err)
+	}
+
+	temperature := float32(0.5)
+
+	_, err = replaying.HTML(context.Background(), "a page", generation.Options{Temperature: &temperature}, nil)
+	if !errors.Is(err, ErrCassetteMiss) {
+		t.Errorf("expected ErrCassetteMiss for different options, got %v", err)
+	}
+}
+
+func TestCassetteWithoutConfig(t *testing.T) {
+	t.Parallel()
+
+	entry := cassetteEntry{
+		DefaultTextModel,
+		"a page",
+		nil,
+		"",
+		[]cassetteChunk{{textChunk("<html><body>old</body></html>"), nil, "", 0}},
+	}
+
+	v, err := json.Marshal(&entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "cassette.jsonl")
+
+	err = os.WriteFile(path, append(v, '\n'), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	replaying, err := NewReplaying(path, generation.Defaults{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	temperature := float32(0.5)
+
+	_, err = replaying.HTML(context.Background(), "a page", generation.Options{Temperature: &temperature}, nil)
+	if err != nil {
+		t.Errorf("expected an entry recorded without options to match any, got %v", err)
+	}
+}
+
+func TestCassetteReplaysRetries(t *testing.T) {
+	t.Parallel()
+
+	policy := RetryPolicy{3, time.Millisecond, 10 * time.Millisecond}
+	unavailable := genai.APIError{Code: http.StatusServiceUnavailable, Message: "busy", Status: "", Details: nil}
+	invalid := genai.APIError{Code: http.StatusBadRequest, Message: "bad", Status: "", Details: nil}
+	page := "<html><body>hello</body></html>"
+
+	tests := []struct {
+		name    string
+		scripts []script
+		calls   int
+		ok      bool
+	}{
+		{"transient", []script{failWith(unavailable), respondWith(page)}, 2, true},
+		{"interrupted", []script{failWith(io.ErrUnexpectedEOF), respondWith(page)}, 2, true},
+		{"permanent", []script{failWith(invalid)}, 1, false},
+	}
+
+	for _, tt := range tests {
+		path := filepath.Join(t.TempDir(), "cassette.jsonl")
+
+		live, liveCalls := scriptedStream(tt.scripts...)
+
+		r, err := newRecorder(live, path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		recording := &Client{r.stream, nil, r, withDefaultModels(generation.Defaults{}), policy}
+
+		_, err = recording.HTML(context.Background(), "a page", generation.Options{}, nil)
+		if (err == nil) != tt.ok || *liveCalls != tt.calls {
+			t.Fatalf("%s: unexpected live run: %d calls, %v", tt.name, *liveCalls, err)
+		}
+
+		err = recording.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rp, err := newReplayer(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var calls int
+
+		replay := func(
+			ctx context.Context,
+			model string,
+			prompt string,
+			image []byte,
+			config *genai.GenerateContentConfig,
+		) iter.Seq2[*genai.GenerateContentResponse, error] {
+			calls++
+			return rp.stream(ctx, model, prompt, image, config)
+		}
+
+		replaying := &Client{replay, nil, rp, withDefaultModels(generation.Defaults{}), policy}
+
+		_, err = replaying.HTML(context.Background(), "a page", generation.Options{}, nil)
+		if (err == nil) != tt.ok || calls != tt.calls {
+			t.Errorf("%s: expected the replay to match the live run, got %d calls, %v", tt.name, calls, err)
+		}
+
+		if !tt.ok && !errors.Is(err, ErrReplayed) {
+			t.Errorf("%s: expected ErrReplayed, got %v", tt.name, err)
+		}
+	}
+}
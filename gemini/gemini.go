@@ -1,61 +1,200 @@
 package gemini
 
 import (
+	"cmp"
 	"context"
 	"errors"
 	"fmt"
+	"io"
+	"iter"
 	"strings"
 
+	"github.com/jasonthorsness/ginprov/generation"
+	"github.com/jasonthorsness/ginprov/tracing"
+	"go.opentelemetry.io/otel/attribute"
 	"golang.org/x/net/html"
 	"google.golang.org/genai"
 )
 
+// Models used when generation.Options does not name one.
 const (
-	htmlModel  = "gemini-2.5-flash-lite-preview-06-17"
-	imageModel = "gemini-2.0-flash-preview-image-generation"
+	DefaultTextModel  = "gemini-2.5-flash-lite-preview-06-17"
+	DefaultImageModel = "gemini-2.0-flash-preview-image-generation"
 )
 
 const (
 	htmlSystemInstructions = "Return only HTML"
 )
 
+// streamFunc streams a response to prompt, with image attached as a JPEG unless it is nil.
+type streamFunc func(
+	ctx context.Context,
+	model string,
+	prompt string,
+	image []byte,
+	config *genai.GenerateContentConfig,
+) iter.Seq2[*genai.GenerateContentResponse, error]
+
 type Client struct {
-	client *genai.Client
+	stream   streamFunc
+	models   *genai.Models
+	closer   io.Closer
+	defaults generation.Defaults
+	retry    RetryPolicy
 }
 
 var ErrResponseUnexpected = errors.New("unexpected response from Gemini")
 
-func New(ctx context.Context, apiKey string) (*Client, error) {
+func New(ctx context.Context, apiKey string, defaults generation.Defaults) (*Client, error) {
+	client, err := newLiveClient(ctx, apiKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Client{liveStream(client), client.Models, nil, withDefaultModels(defaults), DefaultRetryPolicy()}, nil
+}
+
+// NewRecording returns a client that appends every streamed response to the cassette file at path.
+func NewRecording(ctx context.Context, apiKey string, path string, defaults generation.Defaults) (*Client, error) {
+	client, err := newLiveClient(ctx, apiKey)
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := newRecorder(liveStream(client), path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Client{r.stream, client.Models, r, withDefaultModels(defaults), DefaultRetryPolicy()}, nil
+}
+
+// NewReplaying returns a client that serves responses from a cassette recorded by NewRecording, with the original
+// timing between chunks. It never contacts Gemini. Recorded responses are matched by model, prompt and generation
+// options so defaults should be the same as while recording.
+func NewReplaying(path string, defaults generation.Defaults) (*Client, error) {
+	r, err := newReplayer(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Client{r.stream, nil, r, withDefaultModels(defaults), DefaultRetryPolicy()}, nil
+}
+
+func withDefaultModels(defaults generation.Defaults) generation.Defaults {
+	if defaults.Text.Model == "" {
+		defaults.Text.Model = DefaultTextModel
+	}
+
+	if defaults.Image.Model == "" {
+		defaults.Image.Model = DefaultImageModel
+	}
+
+	return defaults
+}
+
+func contentConfig(options generation.Options) *genai.GenerateContentConfig {
+	return &genai.GenerateContentConfig{
+		Temperature:     options.Temperature,
+		TopP:            options.TopP,
+		Seed:            options.Seed,
+		MaxOutputTokens: options.MaxOutputTokens,
+	}
+}
+
+func newLiveClient(ctx context.Context, apiKey string) (*genai.Client, error) {
 	client, err := genai.NewClient(ctx, &genai.ClientConfig{APIKey: apiKey})
 	if err != nil {
 		return nil, fmt.Errorf("failed to initialize gemini client: %w", err)
 	}
 
-	return &Client{client}, nil
+	return client, nil
+}
+
+func liveStream(client *genai.Client) streamFunc {
+	return func(
+		ctx context.Context,
+		model string,
+		prompt string,
+		image []byte,
+		config *genai.GenerateContentConfig,
+	) iter.Seq2[*genai.GenerateContentResponse, error] {
+		contents := genai.Text(prompt)
+		if image != nil {
+			contents[0].Parts = append(contents[0].Parts, genai.NewPartFromBytes(image, "image/jpeg"))
+		}
+
+		return client.Models.GenerateContentStream(ctx, model, contents, config)
+	}
 }
 
 func (g *Client) Close() error {
+	if g.closer == nil {
+		return nil
+	}
+
+	return g.closer.Close()
+}
+
+// Ping checks Gemini is reachable by looking up the text model, which costs no tokens. Replaying clients never
+// contact Gemini so they are always reachable.
+func (g *Client) Ping(ctx context.Context) error {
+	if g.models == nil {
+		return nil
+	}
+
+	_, err := g.models.Get(ctx, g.defaults.Text.Model, nil)
+	if err != nil {
+		return fmt.Errorf("failed to reach Gemini: %w", err)
+	}
+
 	return nil
 }
 
-func (g *Client) HTML(ctx context.Context, prompt string, progress func(string)) (*html.Node, error) {
-	config := &genai.GenerateContentConfig{
-		SystemInstruction: &genai.Content{
-			Parts: []*genai.Part{
-				{Text: htmlSystemInstructions},
-			},
-			Role: "",
+func (g *Client) HTML(
+	ctx context.Context,
+	prompt string,
+	options generation.Options,
+	progress func(string),
+) (*html.Node, error) {
+	model := g.defaults.Text.Merge(options).Model
+
+	return retry(ctx, g.retry, progress, func() (*html.Node, error) {
+		return traced(ctx, "html", model, func(ctx context.Context) (*html.Node, error) {
+			return g.htmlOnce(ctx, prompt, options, progress)
+		})
+	})
+}
+
+func (g *Client) htmlOnce(
+	ctx context.Context,
+	prompt string,
+	options generation.Options,
+	progress func(string),
+) (*html.Node, error) {
+	options = g.defaults.Text.Merge(options)
+
+	config := contentConfig(options)
+	config.SystemInstruction = &genai.Content{
+		Parts: []*genai.Part{
+			{Text: htmlSystemInstructions},
 		},
+		Role: "",
 	}
 
 	var sb strings.Builder
 
-	stream := g.client.Models.GenerateContentStream(ctx, htmlModel, genai.Text(prompt), config)
+	var usage *genai.GenerateContentResponseUsageMetadata
+	defer func() { reportUsage(ctx, usage, 0) }()
+
+	stream := g.stream(ctx, options.Model, prompt, nil, config)
 	for chunk, err := range stream {
 		if err != nil {
-			return nil, err
+			return nil, streamError(err)
 		}
 
+		usage = cmp.Or(chunk.UsageMetadata, usage)
+
 		parts, err := extractSingleCandidateParts(chunk)
 		if err != nil {
 			return nil, err
@@ -87,7 +226,7 @@ func (g *Client) HTML(ctx context.Context, prompt string, progress func(string))
 
 	end := strings.LastIndex(raw, "</html>")
 	if end < 0 {
-		return nil, fmt.Errorf("%w: no </html> closing tag found in response", ErrResponseUnexpected)
+		return nil, fmt.Errorf("%w: %w: no </html> closing tag found", ErrResponseUnexpected, ErrIncomplete)
 	}
 
 	raw = raw[:end+len("</html>")]
@@ -100,25 +239,53 @@ func (g *Client) HTML(ctx context.Context, prompt string, progress func(string))
 	return result, nil
 }
 
-func (g *Client) PNG(ctx context.Context, prompt string, progress func(string)) ([]byte, error) {
-	config := &genai.GenerateContentConfig{
-		ResponseModalities: []string{"TEXT", "IMAGE"},
-	}
+func (g *Client) PNG(
+	ctx context.Context,
+	prompt string,
+	options generation.Options,
+	progress func(string),
+) ([]byte, error) {
+	model := g.defaults.Image.Merge(options).Model
+
+	return retry(ctx, g.retry, progress, func() ([]byte, error) {
+		return traced(ctx, "png", model, func(ctx context.Context) ([]byte, error) {
+			return g.pngOnce(ctx, prompt, options, progress)
+		})
+	})
+}
+
+func (g *Client) pngOnce(
+	ctx context.Context,
+	prompt string,
+	options generation.Options,
+	progress func(string),
+) ([]byte, error) {
+	options = g.defaults.Image.Merge(options)
+
+	config := contentConfig(options)
+	config.ResponseModalities = []string{"TEXT", "IMAGE"}
 
-	stream := g.client.Models.GenerateContentStream(
-		ctx,
-		imageModel,
-		genai.Text(prompt),
-		config,
-	)
+	stream := g.stream(ctx, options.Model, prompt, nil, config)
 
 	var imageBytes []byte
 
+	var usage *genai.GenerateContentResponseUsageMetadata
+	defer func() {
+		var images int64
+		if len(imageBytes) > 0 {
+			images = 1
+		}
+
+		reportUsage(ctx, usage, images)
+	}()
+
 	for chunk, err := range stream {
 		if err != nil {
-			return nil, fmt.Errorf("gemini error %w", err)
+			return nil, fmt.Errorf("gemini error %w", streamError(err))
 		}
 
+		usage = cmp.Or(chunk.UsageMetadata, usage)
+
 		parts, err := extractSingleCandidateParts(chunk)
 		if err != nil {
 			return nil, err
@@ -140,23 +307,62 @@ func (g *Client) PNG(ctx context.Context, prompt string, progress func(string))
 	}
 
 	if len(imageBytes) == 0 {
-		return nil, fmt.Errorf("%w: no image received", ErrResponseUnexpected)
+		return nil, fmt.Errorf("%w: %w: no image received", ErrResponseUnexpected, ErrIncomplete)
 	}
 
 	return imageBytes, nil
 }
 
-func (g *Client) Text(ctx context.Context, prompt string, progress func(string)) (string, error) {
-	config := &genai.GenerateContentConfig{}
+func (g *Client) Text(
+	ctx context.Context,
+	prompt string,
+	options generation.Options,
+	progress func(string),
+) (string, error) {
+	model := g.defaults.Text.Merge(options).Model
+
+	return retry(ctx, g.retry, progress, func() (string, error) {
+		return traced(ctx, "text", model, func(ctx context.Context) (string, error) {
+			return g.textOnce(ctx, prompt, nil, options, progress)
+		})
+	})
+}
+
+// Vision returns the response to prompt about a JPEG image.
+func (g *Client) Vision(ctx context.Context, prompt string, jpg []byte, options generation.Options) (string, error) {
+	model := g.defaults.Text.Merge(options).Model
+
+	return retry(ctx, g.retry, nil, func() (string, error) {
+		return traced(ctx, "vision", model, func(ctx context.Context) (string, error) {
+			return g.textOnce(ctx, prompt, jpg, options, nil)
+		})
+	})
+}
+
+func (g *Client) textOnce(
+	ctx context.Context,
+	prompt string,
+	image []byte,
+	options generation.Options,
+	progress func(string),
+) (string, error) {
+	options = g.defaults.Text.Merge(options)
+
+	config := contentConfig(options)
 
 	var sb strings.Builder
 
-	stream := g.client.Models.GenerateContentStream(ctx, htmlModel, genai.Text(prompt), config)
+	var usage *genai.GenerateContentResponseUsageMetadata
+	defer func() { reportUsage(ctx, usage, 0) }()
+
+	stream := g.stream(ctx, options.Model, prompt, image, config)
 	for chunk, err := range stream {
 		if err != nil {
-			return "", err
+			return "", streamError(err)
 		}
 
+		usage = cmp.Or(chunk.UsageMetadata, usage)
+
 		parts, err := extractSingleCandidateParts(chunk)
 		if err != nil {
 			return "", err
@@ -182,6 +388,28 @@ func (g *Client) Text(ctx context.Context, prompt string, progress func(string))
 	return result, nil
 }
 
+// traced runs a single streamed request in its own span, so each retry shows up separately.
+func traced[T any](ctx context.Context, kind, model string, f func(context.Context) (T, error)) (T, error) {
+	ctx, span := tracing.Start(ctx, "gemini.stream", attribute.String("kind", kind), attribute.String("model", model))
+
+	v, err := f(ctx)
+	tracing.End(span, err)
+
+	return v, err
+}
+
+// reportUsage reports the usage metadata from the last chunk that carried any, which covers the whole stream.
+func reportUsage(ctx context.Context, v *genai.GenerateContentResponseUsageMetadata, images int64) {
+	u := generation.Usage{InputTokens: 0, OutputTokens: 0, Images: images}
+
+	if v != nil {
+		u.InputTokens = int64(v.PromptTokenCount)
+		u.OutputTokens = int64(v.CandidatesTokenCount) + int64(v.ThoughtsTokenCount)
+	}
+
+	generation.ReportUsage(ctx, u)
+}
+
 func extractSingleCandidateParts(v *genai.GenerateContentResponse) ([]*genai.Part, error) {
 	if len(v.Candidates) != 1 {
 		return nil, fmt.Errorf("%w: expected one candidate, got %d", ErrResponseUnexpected, len(v.Candidates))
@@ -0,0 +1,148 @@
+package gemini
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"time"
+
+	"github.com/jasonthorsness/ginprov/generation"
+	"google.golang.org/genai"
+)
+
+var (
+	// ErrStreamInterrupted wraps errors from the transport rather than from the API, such as a dropped connection.
+	ErrStreamInterrupted = errors.New("stream interrupted")
+	// ErrIncomplete is returned when a stream ends without the expected content, such as a closing </html>.
+	ErrIncomplete = errors.New("incomplete response")
+)
+
+// RetryPolicy decides how often, and after how long, a failed request is repeated. Delays double from BaseDelay up
+// to MaxDelay with jitter. A Retry-After from the API is honored, unless it is beyond MaxDelay, in which case the
+// request fails right away.
+type RetryPolicy struct {
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+}
+
+func DefaultRetryPolicy() RetryPolicy {
+	const (
+		maxAttempts = 3
+		baseDelay   = time.Second
+		maxDelay    = 30 * time.Second
+	)
+
+	return RetryPolicy{maxAttempts, baseDelay, maxDelay}
+}
+
+// retry calls f until it succeeds, fails permanently or runs out of attempts. Each retry is reported through
+// generation.ReportRetry or, failing that, progress, which may be nil.
+func retry[T any](ctx context.Context, p RetryPolicy, progress func(string), f func() (T, error)) (T, error) {
+	for attempt := 1; ; attempt++ {
+		v, err := f()
+		if err == nil {
+			return v, nil
+		}
+
+		reason, delay, ok := p.next(attempt, err)
+		if !ok {
+			return v, err
+		}
+
+		r := generation.Retry{Reason: reason, Attempt: attempt + 1, MaxAttempts: p.MaxAttempts, Delay: delay}
+		if !generation.ReportRetry(ctx, r) && progress != nil {
+			progress("\n\nGemini " + r.String() + "...\n\n")
+		}
+
+		t := time.NewTimer(delay)
+
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return v, err
+		case <-t.C:
+		}
+	}
+}
+
+// next returns why err is worth retrying and how long to wait first, or false if it is not.
+func (p RetryPolicy) next(attempt int, err error) (string, time.Duration, bool) {
+	if attempt >= p.MaxAttempts {
+		return "", 0, false
+	}
+
+	reason, retryAfter, ok := classify(err)
+	if !ok {
+		return "", 0, false
+	}
+
+	if retryAfter > p.MaxDelay {
+		return "", 0, false
+	}
+
+	backoff := min(p.MaxDelay, p.BaseDelay<<(attempt-1))
+	delay := backoff/2 + time.Duration(rand.Int64N(int64(backoff/2)+1)) //nolint:gosec // jitter need not be secure
+
+	return reason, max(delay, retryAfter), true
+}
+
+// classify reports whether err is transient and, if the API said so, how long to wait before trying again.
+func classify(err error) (string, time.Duration, bool) {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return "", 0, false
+	}
+
+	var apiErr genai.APIError
+	if errors.As(err, &apiErr) {
+		if apiErr.Code == http.StatusTooManyRequests || apiErr.Code >= http.StatusInternalServerError {
+			return fmt.Sprintf("HTTP %d", apiErr.Code), retryDelay(apiErr), true
+		}
+
+		return "", 0, false
+	}
+
+	switch {
+	case errors.Is(err, ErrStreamInterrupted):
+		return ErrStreamInterrupted.Error(), 0, true
+	case errors.Is(err, ErrIncomplete):
+		return ErrIncomplete.Error(), 0, true
+	default:
+		return "", 0, false
+	}
+}
+
+// retryDelay extracts the google.rpc.RetryInfo detail, which is how the Gemini API conveys Retry-After.
+func retryDelay(apiErr genai.APIError) time.Duration {
+	for _, detail := range apiErr.Details {
+		if detail["@type"] != "type.googleapis.com/google.rpc.RetryInfo" {
+			continue
+		}
+
+		v, ok := detail["retryDelay"].(string)
+		if !ok {
+			continue
+		}
+
+		d, err := time.ParseDuration(v)
+		if err == nil {
+			return d
+		}
+	}
+
+	return 0
+}
+
+// streamError marks errors that did not come from the API, or from a cassette lacking the request, as
+// interruptions of the stream.
+func streamError(err error) error {
+	var apiErr genai.APIError
+	if errors.As(err, &apiErr) || errors.Is(err, ErrCassetteMiss) ||
+		errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return err
+	}
+
+	return fmt.Errorf("%w: %w", ErrStreamInterrupted, err)
+}
@@ -0,0 +1,118 @@
+package gemini
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"iter"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jasonthorsness/ginprov/generation"
+	"google.golang.org/genai"
+)
+
+type script = func(yield func(*genai.GenerateContentResponse, error) bool)
+
+// scriptedStream serves one script per call, repeating the last one once they run out.
+func scriptedStream(scripts ...script) (streamFunc, *int) {
+	calls := 0
+
+	return func(
+		_ context.Context,
+		_ string,
+		_ string,
+		_ []byte,
+		_ *genai.GenerateContentConfig,
+	) iter.Seq2[*genai.GenerateContentResponse, error] {
+		s := scripts[min(calls, len(scripts)-1)]
+		calls++
+
+		return s
+	}, &calls
+}
+
+func failWith(err error) script {
+	return func(yield func(*genai.GenerateContentResponse, error) bool) {
+		yield(nil, err)
+	}
+}
+
+func respondWith(v string) script {
+	return func(yield func(*genai.GenerateContentResponse, error) bool) {
+		yield(textChunk(v), nil)
+	}
+}
+
+func TestRetry(t *testing.T) {
+	t.Parallel()
+
+	policy := RetryPolicy{3, time.Millisecond, 10 * time.Millisecond}
+	unavailable := genai.APIError{Code: http.StatusServiceUnavailable, Message: "", Status: "", Details: nil}
+	invalid := genai.APIError{Code: http.StatusBadRequest, Message: "", Status: "", Details: nil}
+	page := "<html><body>hello</body></html>"
+
+	tests := []struct {
+		name    string
+		scripts []script
+		calls   int
+		retries int
+		ok      bool
+	}{
+		{"server error", []script{failWith(unavailable), respondWith(page)}, 2, 1, true},
+		{"interrupted", []script{failWith(io.ErrUnexpectedEOF), respondWith(page)}, 2, 1, true},
+		{"truncated", []script{respondWith("<html><body>hel"), respondWith(page)}, 2, 1, true},
+		{"permanent", []script{failWith(invalid), respondWith(page)}, 1, 0, false},
+		{"replayed", []script{failWith(fmt.Errorf("%w: EOF", ErrReplayed)), respondWith(page)}, 2, 1, true},
+		{"replayed permanent", []script{failWith(fmt.Errorf("%w: %w", ErrReplayed, invalid))}, 1, 0, false},
+		{"exhausted", []script{failWith(unavailable)}, 3, 2, false},
+	}
+
+	for _, tt := range tests {
+		stream, calls := scriptedStream(tt.scripts...)
+		c := &Client{stream, nil, nil, withDefaultModels(generation.Defaults{}), policy}
+
+		retries := 0
+
+		progress := func(v string) {
+			if strings.Contains(v, "retrying") {
+				retries++
+			}
+		}
+
+		_, err := c.HTML(context.Background(), "a page", generation.Options{}, progress)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: unexpected error %v", tt.name, err)
+		}
+
+		if *calls != tt.calls || retries != tt.retries {
+			t.Errorf("%s: expected %d calls and %d retries, got %d and %d", tt.name, tt.calls, tt.retries, *calls, retries)
+		}
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	t.Parallel()
+
+	policy := RetryPolicy{3, time.Millisecond, time.Minute}
+	err := genai.APIError{
+		Code:    http.StatusTooManyRequests,
+		Message: "",
+		Status:  "",
+		Details: []map[string]any{{"@type": "type.googleapis.com/google.rpc.RetryInfo", "retryDelay": "7s"}},
+	}
+
+	_, delay, ok := policy.next(1, err)
+	if !ok || delay != 7*time.Second {
+		t.Errorf("expected to wait 7s, got %v %v", delay, ok)
+	}
+
+	policy.MaxDelay = time.Second
+
+	_, _, ok = policy.next(1, err)
+	if ok {
+		t.Error("expected a Retry-After beyond MaxDelay to fail right away")
+	}
+}
@@ -0,0 +1,41 @@
+package generation
+
+// Options tunes a single generation request. Zero values mean the provider default applies.
+type Options struct {
+	Model           string
+	Temperature     *float32
+	TopP            *float32
+	Seed            *int32
+	MaxOutputTokens int32
+}
+
+// Merge returns a copy of o with every field set in override replacing its counterpart.
+func (o Options) Merge(override Options) Options {
+	if override.Model != "" {
+		o.Model = override.Model
+	}
+
+	if override.Temperature != nil {
+		o.Temperature = override.Temperature
+	}
+
+	if override.TopP != nil {
+		o.TopP = override.TopP
+	}
+
+	if override.Seed != nil {
+		o.Seed = override.Seed
+	}
+
+	if override.MaxOutputTokens != 0 {
+		o.MaxOutputTokens = override.MaxOutputTokens
+	}
+
+	return o
+}
+
+// Defaults are the options a provider starts from for each kind of request, before per-request overrides.
+type Defaults struct {
+	Text  Options
+	Image Options
+}
@@ -0,0 +1,52 @@
+package generation
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMerge(t *testing.T) {
+	t.Parallel()
+
+	low, high := float32(0.2), float32(0.9)
+	seed, other := int32(1), int32(2)
+
+	base := Options{Model: "base", Temperature: &low, TopP: nil, Seed: &seed, MaxOutputTokens: 100}
+
+	tests := []struct {
+		name     string
+		override Options
+		expected Options
+	}{
+		{"empty override", Options{}, base},
+		{"model", Options{Model: "other"}, Options{"other", &low, nil, &seed, 100}},
+		{"temperature", Options{Temperature: &high}, Options{"base", &high, nil, &seed, 100}},
+		{"top p", Options{TopP: &high}, Options{"base", &low, &high, &seed, 100}},
+		{"seed", Options{Seed: &other}, Options{"base", &low, nil, &other, 100}},
+		{"max output tokens", Options{MaxOutputTokens: 5}, Options{"base", &low, nil, &seed, 5}},
+		{"everything", Options{"other", &high, &high, &other, 5}, Options{"other", &high, &high, &other, 5}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			got := base.Merge(tt.override)
+			if !reflect.DeepEqual(got, tt.expected) {
+				t.Errorf("expected %+v, got %+v", tt.expected, got)
+			}
+		})
+	}
+
+	// a zero temperature is set, not missing
+	var zero float32
+
+	got := base.Merge(Options{Temperature: &zero})
+	if got.Temperature == nil || *got.Temperature != 0 {
+		t.Errorf("expected a zero temperature to override, got %v", got.Temperature)
+	}
+
+	if base.Model != "base" || base.Temperature != &low {
+		t.Error("expected Merge to leave the receiver unchanged")
+	}
+}
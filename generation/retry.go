@@ -0,0 +1,40 @@
+package generation
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Retry describes a failed request that a provider is about to repeat.
+type Retry struct {
+	Reason      string
+	Attempt     int
+	MaxAttempts int
+	Delay       time.Duration
+}
+
+func (r Retry) String() string {
+	const precision = 100 * time.Millisecond
+
+	return fmt.Sprintf("request failed (%s), retrying in %s (attempt %d/%d)",
+		r.Reason, r.Delay.Round(precision), r.Attempt, r.MaxAttempts)
+}
+
+type retryKey struct{}
+
+// WithRetry returns a context under which retries passed to ReportRetry are forwarded to report.
+func WithRetry(ctx context.Context, report func(Retry)) context.Context {
+	return context.WithValue(ctx, retryKey{}, report)
+}
+
+// ReportRetry is called by providers before each retry. It returns false if nobody is listening, in which case
+// providers should describe the retry through their progress callback instead.
+func ReportRetry(ctx context.Context, r Retry) bool {
+	report, ok := ctx.Value(retryKey{}).(func(Retry))
+	if ok {
+		report(r)
+	}
+
+	return ok
+}
@@ -0,0 +1,8 @@
+package generation
+
+// Safe is the whole response to a safety prompt when the content is safe.
+const Safe = "SAFE"
+
+// SafetyRequest is part of every safety prompt, asking for Safe or for why the content is not safe. Providers that
+// don't call a model, such as fake.Client, recognize safety prompts by it.
+const SafetyRequest = `respond with the single word "` + Safe + `"`
@@ -0,0 +1,33 @@
+package generation
+
+import (
+	"context"
+)
+
+// Usage counts what generation consumed from a provider.
+type Usage struct {
+	InputTokens  int64 `json:"inputTokens"`
+	OutputTokens int64 `json:"outputTokens"`
+	Images       int64 `json:"images"`
+}
+
+func (u *Usage) Add(v Usage) {
+	u.InputTokens += v.InputTokens
+	u.OutputTokens += v.OutputTokens
+	u.Images += v.Images
+}
+
+type usageKey struct{}
+
+// WithUsage returns a context under which usage passed to ReportUsage is forwarded to report.
+func WithUsage(ctx context.Context, report func(Usage)) context.Context {
+	return context.WithValue(ctx, usageKey{}, report)
+}
+
+// ReportUsage is called by providers once per request, whether or not it succeeded.
+func ReportUsage(ctx context.Context, u Usage) {
+	report, ok := ctx.Value(usageKey{}).(func(Usage))
+	if ok {
+		report(u)
+	}
+}
@@ -0,0 +1,297 @@
+// Package metrics is a small collection of counters, histograms and gauges served in the Prometheus text exposition
+// format, so ginprov can be scraped without pulling in a client library.
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// Registry holds metrics in the order they were created and serves them over HTTP.
+type Registry struct {
+	metrics []metric
+	names   map[string]struct{}
+	mu      sync.Mutex
+}
+
+type metric interface {
+	write(b *bytes.Buffer)
+}
+
+func NewRegistry() *Registry {
+	return &Registry{nil, make(map[string]struct{}), sync.Mutex{}}
+}
+
+func (r *Registry) add(name string, m metric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	_, ok := r.names[name]
+	if ok {
+		panic("duplicate metric " + name)
+	}
+
+	r.names[name] = struct{}{}
+	r.metrics = append(r.metrics, m)
+}
+
+func (r *Registry) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	r.mu.Lock()
+	metrics := slices.Clone(r.metrics)
+	r.mu.Unlock()
+
+	var b bytes.Buffer
+
+	for _, m := range metrics {
+		m.write(&b)
+	}
+
+	w.Header().Set("Content-Type", ContentType)
+	w.Header().Set("Cache-Control", "no-store")
+
+	_, _ = w.Write(b.Bytes())
+}
+
+// family is the set of series of one metric, one per combination of label values.
+type family[T any] struct {
+	name   string
+	help   string
+	labels []string
+	series map[string]*series[T]
+	mu     sync.Mutex
+}
+
+type series[T any] struct {
+	values []string
+	v      T
+}
+
+func newFamily[T any](name, help string, labels []string) *family[T] {
+	f := &family[T]{name, help, labels, make(map[string]*series[T]), sync.Mutex{}}
+
+	// without labels there is only one series, which is reported from the start
+	if len(labels) == 0 {
+		f.with(nil)
+	}
+
+	return f
+}
+
+// with returns the series for values, creating it with zero value on first use. f.mu must be held.
+func (f *family[T]) with(values []string) *series[T] {
+	if len(values) != len(f.labels) {
+		panic(fmt.Sprintf("metric %s takes %d label values, got %d", f.name, len(f.labels), len(values)))
+	}
+
+	key := strings.Join(values, "\xff")
+
+	s, ok := f.series[key]
+	if !ok {
+		var zero T
+
+		s = &series[T]{slices.Clone(values), zero}
+		f.series[key] = s
+	}
+
+	return s
+}
+
+// sorted returns the series ordered by label values so output is stable. f.mu must be held.
+func (f *family[T]) sorted() []*series[T] {
+	v := make([]*series[T], 0, len(f.series))
+
+	for _, s := range f.series {
+		v = append(v, s)
+	}
+
+	slices.SortFunc(v, func(a, b *series[T]) int {
+		return slices.Compare(a.values, b.values)
+	})
+
+	return v
+}
+
+func (f *family[T]) writeHead(b *bytes.Buffer, kind string) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", f.name, escapeHelp(f.help), f.name, kind)
+}
+
+// Counter is a monotonically increasing value per combination of label values.
+type Counter struct {
+	f *family[float64]
+}
+
+// NewCounter registers a counter with the given label names.
+func (r *Registry) NewCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{newFamily[float64](name, help, labels)}
+	r.add(name, c)
+
+	return c
+}
+
+// Add increases the counter for the label values, given in the order of the label names, by v.
+func (c *Counter) Add(v float64, values ...string) {
+	c.f.mu.Lock()
+	defer c.f.mu.Unlock()
+
+	c.f.with(values).v += v
+}
+
+func (c *Counter) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+func (c *Counter) write(b *bytes.Buffer) {
+	c.f.mu.Lock()
+	defer c.f.mu.Unlock()
+
+	c.f.writeHead(b, "counter")
+
+	for _, s := range c.f.sorted() {
+		writeSample(b, c.f.name, c.f.labels, s.values, "", "", s.v)
+	}
+}
+
+// Histogram counts observations into buckets per combination of label values.
+type Histogram struct {
+	f       *family[histogramData]
+	buckets []float64
+}
+
+type histogramData struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// NewHistogram registers a histogram with the given upper bucket bounds, in increasing order, and label names.
+func (r *Registry) NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	h := &Histogram{newFamily[histogramData](name, help, labels), slices.Clone(buckets)}
+	r.add(name, h)
+
+	return h
+}
+
+// Observe records v for the label values, given in the order of the label names.
+func (h *Histogram) Observe(v float64, values ...string) {
+	h.f.mu.Lock()
+	defer h.f.mu.Unlock()
+
+	s := h.f.with(values)
+
+	if s.v.counts == nil {
+		s.v.counts = make([]uint64, len(h.buckets))
+	}
+
+	for i, upper := range h.buckets {
+		if v <= upper {
+			s.v.counts[i]++
+		}
+	}
+
+	s.v.sum += v
+	s.v.count++
+}
+
+func (h *Histogram) write(b *bytes.Buffer) {
+	h.f.mu.Lock()
+	defer h.f.mu.Unlock()
+
+	h.f.writeHead(b, "histogram")
+
+	for _, s := range h.f.sorted() {
+		for i, upper := range h.buckets {
+			var n uint64
+			if s.v.counts != nil {
+				n = s.v.counts[i]
+			}
+
+			writeSample(b, h.f.name+"_bucket", h.f.labels, s.values, "le", formatValue(upper), float64(n))
+		}
+
+		writeSample(b, h.f.name+"_bucket", h.f.labels, s.values, "le", "+Inf", float64(s.v.count))
+		writeSample(b, h.f.name+"_sum", h.f.labels, s.values, "", "", s.v.sum)
+		writeSample(b, h.f.name+"_count", h.f.labels, s.values, "", "", float64(s.v.count))
+	}
+}
+
+// GaugeFunc reports the value of a function each time metrics are served.
+type GaugeFunc struct {
+	name string
+	help string
+	f    func() float64
+}
+
+// NewGaugeFunc registers a gauge whose value is read from f, which must be safe to call concurrently.
+func (r *Registry) NewGaugeFunc(name, help string, f func() float64) *GaugeFunc {
+	g := &GaugeFunc{name, help, f}
+	r.add(name, g)
+
+	return g
+}
+
+func (g *GaugeFunc) write(b *bytes.Buffer) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s gauge\n", g.name, escapeHelp(g.help), g.name)
+	writeSample(b, g.name, nil, nil, "", "", g.f())
+}
+
+func writeSample(b *bytes.Buffer, name string, labels, values []string, extra, extraValue string, v float64) {
+	b.WriteString(name)
+
+	if len(labels) > 0 || extra != "" {
+		b.WriteByte('{')
+
+		for i, label := range labels {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+
+			fmt.Fprintf(b, "%s=\"%s\"", label, escapeLabel(values[i]))
+		}
+
+		if extra != "" {
+			if len(labels) > 0 {
+				b.WriteByte(',')
+			}
+
+			fmt.Fprintf(b, "%s=\"%s\"", extra, extraValue)
+		}
+
+		b.WriteByte('}')
+	}
+
+	b.WriteByte(' ')
+	b.WriteString(formatValue(v))
+	b.WriteByte('\n')
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	default:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	}
+}
+
+var (
+	labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`) //nolint:gochecknoglobals
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)            //nolint:gochecknoglobals
+)
+
+func escapeLabel(v string) string {
+	return labelEscaper.Replace(v)
+}
+
+func escapeHelp(v string) string {
+	return helpEscaper.Replace(v)
+}
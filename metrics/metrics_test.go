@@ -0,0 +1,53 @@
+package metrics
+
+import (
+	"io"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRegistry(t *testing.T) {
+	t.Parallel()
+
+	r := NewRegistry()
+
+	c := r.NewCounter("test_requests_total", "Requests.", "kind")
+	h := r.NewHistogram("test_duration_seconds", "Durations.", []float64{1, 5}, "kind")
+	r.NewGaugeFunc("test_depth", "Depth.", func() float64 { return 3 })
+
+	c.Inc("html")
+	c.Add(2, "jpg")
+	c.Inc(`a"b`)
+	h.Observe(0.5, "html")
+	h.Observe(2, "html")
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+
+	if got := w.Header().Get("Content-Type"); got != ContentType {
+		t.Errorf("expected content type %q, got %q", ContentType, got)
+	}
+
+	body, _ := io.ReadAll(w.Body)
+
+	want := `# HELP test_requests_total Requests.
+# TYPE test_requests_total counter
+test_requests_total{kind="a\"b"} 1
+test_requests_total{kind="html"} 1
+test_requests_total{kind="jpg"} 2
+# HELP test_duration_seconds Durations.
+# TYPE test_duration_seconds histogram
+test_duration_seconds_bucket{kind="html",le="1"} 1
+test_duration_seconds_bucket{kind="html",le="5"} 2
+test_duration_seconds_bucket{kind="html",le="+Inf"} 2
+test_duration_seconds_sum{kind="html"} 2.5
+test_duration_seconds_count{kind="html"} 2
+# HELP test_depth Depth.
+# TYPE test_depth gauge
+test_depth 3
+`
+
+	if string(body) != want {
+		t.Errorf("expected\n%s\ngot\n%s", want, body)
+	}
+}
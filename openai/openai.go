@@ -0,0 +1,393 @@
+package openai
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/jasonthorsness/ginprov/generation"
+	"golang.org/x/net/html"
+)
+
+const (
+	htmlSystemInstructions = "Return only HTML"
+)
+
+var (
+	ErrResponseUnexpected = errors.New("unexpected response from OpenAI-compatible server")
+	ErrUnexpectedStatus   = errors.New("unexpected status from OpenAI-compatible server")
+)
+
+// Config describes how to reach an OpenAI-compatible server such as llama.cpp or vLLM.
+type Config struct {
+	// BaseURL is the API root, for example http://localhost:8000/v1.
+	BaseURL string
+	// APIKey is sent as a bearer token when not empty.
+	APIKey   string
+	Defaults generation.Defaults
+}
+
+// DefaultModel is sent when generation.Options does not name a model. Single-model servers typically ignore it.
+const DefaultModel = "default"
+
+type Client struct {
+	config Config
+	client *http.Client
+}
+
+func New(config Config) *Client {
+	config.BaseURL = strings.TrimSuffix(config.BaseURL, "/")
+
+	if config.Defaults.Text.Model == "" {
+		config.Defaults.Text.Model = DefaultModel
+	}
+
+	if config.Defaults.Image.Model == "" {
+		config.Defaults.Image.Model = DefaultModel
+	}
+
+	return &Client{config, &http.Client{}}
+}
+
+func (c *Client) Close() error {
+	c.client.CloseIdleConnections()
+	return nil
+}
+
+func (c *Client) HTML(
+	ctx context.Context,
+	prompt string,
+	options generation.Options,
+	progress func(string),
+) (*html.Node, error) {
+	raw, err := c.chat(ctx, htmlSystemInstructions, prompt, nil, c.config.Defaults.Text.Merge(options), progress)
+	if err != nil {
+		return nil, err
+	}
+
+	start := strings.Index(raw, "<html")
+	if start < 0 {
+		return nil, fmt.Errorf("%w: no <html> tag found in response", ErrResponseUnexpected)
+	}
+
+	raw = raw[start:]
+
+	end := strings.LastIndex(raw, "</html>")
+	if end < 0 {
+		return nil, fmt.Errorf("%w: no </html> closing tag found in response", ErrResponseUnexpected)
+	}
+
+	raw = raw[:end+len("</html>")]
+
+	result, err := html.Parse(strings.NewReader(raw))
+	if err != nil {
+		return nil, fmt.Errorf("html.Parse failed: %w", err)
+	}
+
+	return result, nil
+}
+
+func (c *Client) Text(
+	ctx context.Context,
+	prompt string,
+	options generation.Options,
+	progress func(string),
+) (string, error) {
+	return c.chat(ctx, "", prompt, nil, c.config.Defaults.Text.Merge(options), progress)
+}
+
+// Vision returns the response to prompt about a JPEG image, which needs a server and model that accept image input.
+func (c *Client) Vision(ctx context.Context, prompt string, jpg []byte, options generation.Options) (string, error) {
+	return c.chat(ctx, "", prompt, jpg, c.config.Defaults.Text.Merge(options), nil)
+}
+
+// PNG generates an image with the images endpoint. The endpoint does not stream so progress only reports the start.
+func (c *Client) PNG(
+	ctx context.Context,
+	prompt string,
+	options generation.Options,
+	progress func(string),
+) ([]byte, error) {
+	options = c.config.Defaults.Image.Merge(options)
+
+	if progress != nil {
+		progress("Generating image with " + options.Model + "...\n")
+	}
+
+	body := imageRequest{options.Model, prompt, "b64_json", options.Seed, 1}
+
+	resp, err := c.post(ctx, "/images/generations", body)
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		_ = resp.Body.Close() // read only
+	}()
+
+	var result imageResponse
+
+	err = json.NewDecoder(resp.Body).Decode(&result)
+	if err != nil {
+		return nil, fmt.Errorf("%w: failed to decode image response: %w", ErrResponseUnexpected, err)
+	}
+
+	usage := generation.Usage{InputTokens: 0, OutputTokens: 0, Images: int64(len(result.Data))}
+	if result.Usage != nil {
+		usage.InputTokens = result.Usage.InputTokens
+		usage.OutputTokens = result.Usage.OutputTokens
+	}
+
+	generation.ReportUsage(ctx, usage)
+
+	if len(result.Data) != 1 {
+		return nil, fmt.Errorf("%w: expected one image, got %d", ErrResponseUnexpected, len(result.Data))
+	}
+
+	imageBytes, err := base64.StdEncoding.DecodeString(result.Data[0].B64JSON)
+	if err != nil {
+		return nil, fmt.Errorf("%w: failed to decode image data: %w", ErrResponseUnexpected, err)
+	}
+
+	if len(imageBytes) == 0 {
+		return nil, fmt.Errorf("%w: no image received", ErrResponseUnexpected)
+	}
+
+	return imageBytes, nil
+}
+
+// chatMessage content is a string, or a slice of contentPart to attach an image.
+type chatMessage struct {
+	Content any    `json:"content"`
+	Role    string `json:"role"`
+}
+
+type contentPart struct {
+	ImageURL *imageURL `json:"image_url,omitempty"`
+	Type     string    `json:"type"`
+	Text     string    `json:"text,omitempty"`
+}
+
+type imageURL struct {
+	URL string `json:"url"`
+}
+
+type streamOptions struct {
+	IncludeUsage bool `json:"include_usage"`
+}
+
+type chatRequest struct {
+	Temperature   *float32      `json:"temperature,omitempty"`
+	TopP          *float32      `json:"top_p,omitempty"`
+	Seed          *int32        `json:"seed,omitempty"`
+	Model         string        `json:"model"`
+	Messages      []chatMessage `json:"messages"`
+	StreamOptions streamOptions `json:"stream_options"`
+	MaxTokens     int32         `json:"max_tokens,omitempty"`
+	Stream        bool          `json:"stream"`
+}
+
+type chatUsage struct {
+	PromptTokens     int64 `json:"prompt_tokens"`
+	CompletionTokens int64 `json:"completion_tokens"`
+}
+
+type chatChunk struct {
+	Usage   *chatUsage `json:"usage"`
+	Choices []struct {
+		Delta struct {
+			Content string `json:"content"`
+		} `json:"delta"`
+	} `json:"choices"`
+}
+
+type imageRequest struct {
+	Model          string `json:"model"`
+	Prompt         string `json:"prompt"`
+	ResponseFormat string `json:"response_format"`
+	Seed           *int32 `json:"seed,omitempty"`
+	N              int    `json:"n"`
+}
+
+type imageUsage struct {
+	InputTokens  int64 `json:"input_tokens"`
+	OutputTokens int64 `json:"output_tokens"`
+}
+
+type imageResponse struct {
+	Usage *imageUsage `json:"usage"`
+	Data  []struct {
+		B64JSON string `json:"b64_json"`
+	} `json:"data"`
+}
+
+func (c *Client) chat(
+	ctx context.Context,
+	system string,
+	prompt string,
+	image []byte,
+	options generation.Options,
+	progress func(string),
+) (string, error) {
+	messages := make([]chatMessage, 0, 2)
+
+	if system != "" {
+		messages = append(messages, chatMessage{system, "system"})
+	}
+
+	if image == nil {
+		messages = append(messages, chatMessage{prompt, "user"})
+	} else {
+		messages = append(messages, chatMessage{[]contentPart{
+			{nil, "text", prompt},
+			{&imageURL{"data:image/jpeg;base64," + base64.StdEncoding.EncodeToString(image)}, "image_url", ""},
+		}, "user"})
+	}
+
+	body := chatRequest{
+		options.Temperature,
+		options.TopP,
+		options.Seed,
+		options.Model,
+		messages,
+		streamOptions{IncludeUsage: true},
+		options.MaxOutputTokens,
+		true,
+	}
+
+	resp, err := c.post(ctx, "/chat/completions", body)
+	if err != nil {
+		return "", err
+	}
+
+	// servers send usage in a final chunk with no choices
+	var usage generation.Usage
+	defer func() { generation.ReportUsage(ctx, usage) }()
+
+	defer func() {
+		_ = resp.Body.Close() // read only
+	}()
+
+	var sb strings.Builder
+
+	scanner := bufio.NewScanner(resp.Body)
+
+	const maxLineSize = 1 << 20
+
+	scanner.Buffer(nil, maxLineSize)
+
+	for scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data:")
+		if !ok {
+			continue // blank separators, comments and other SSE fields
+		}
+
+		data = strings.TrimSpace(data)
+		if data == "[DONE]" {
+			return sb.String(), nil
+		}
+
+		var chunk chatChunk
+
+		err = json.Unmarshal([]byte(data), &chunk)
+		if err != nil {
+			return "", fmt.Errorf("%w: failed to decode chunk: %w", ErrResponseUnexpected, err)
+		}
+
+		if chunk.Usage != nil {
+			usage.InputTokens = chunk.Usage.PromptTokens
+			usage.OutputTokens = chunk.Usage.CompletionTokens
+		}
+
+		if len(chunk.Choices) == 0 {
+			continue
+		}
+
+		if len(chunk.Choices) != 1 {
+			return "", fmt.Errorf("%w: expected one choice, got %d", ErrResponseUnexpected, len(chunk.Choices))
+		}
+
+		text := chunk.Choices[0].Delta.Content
+		if text == "" {
+			continue
+		}
+
+		if progress != nil {
+			progress(text)
+		}
+
+		sb.WriteString(text)
+	}
+
+	err = scanner.Err()
+	if err != nil {
+		return "", fmt.Errorf("failed to read stream: %w", err)
+	}
+
+	return "", fmt.Errorf("%w: stream ended without [DONE]", ErrResponseUnexpected)
+}
+
+func (c *Client) post(ctx context.Context, path string, body any) (*http.Response, error) {
+	v, err := json.Marshal(body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode request: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.config.BaseURL+path, bytes.NewReader(v))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+
+	return c.do(req, path)
+}
+
+// Ping checks the server is reachable by listing its models, which costs nothing.
+func (c *Client) Ping(ctx context.Context) error {
+	const path = "/models"
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.config.BaseURL+path, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+
+	resp, err := c.do(req, path)
+	if err != nil {
+		return err
+	}
+
+	_ = resp.Body.Close()
+
+	return nil
+}
+
+// do sends req, failing unless the response is 200 OK. The caller must close the body.
+func (c *Client) do(req *http.Request, path string) (*http.Response, error) {
+	if c.config.APIKey != "" {
+		req.Header.Set("Authorization", "Bearer "+c.config.APIKey)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("request to %s failed: %w", path, err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		const maxErrorBody = 1024
+
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBody))
+		_ = resp.Body.Close()
+
+		return nil, fmt.Errorf("%w: %s %d %s", ErrUnexpectedStatus, path, resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+
+	return resp, nil
+}
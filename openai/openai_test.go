@@ -0,0 +1,175 @@
+package openai
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/jasonthorsness/ginprov/generation"
+)
+
+func newStandIn(t *testing.T) *httptest.Server {
+	t.Helper()
+
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("POST /v1/chat/completions", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		var req chatRequest
+
+		err := json.NewDecoder(r.Body).Decode(&req)
+		ok := err == nil && req.Stream && req.Model == "text-model" && req.Temperature != nil && *req.Temperature == 0.5
+		if !ok || !validContent(req.Messages[len(req.Messages)-1].Content) {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/event-stream")
+
+		for _, v := range []string{"Sure! <html><body>", "hi", "</body></html> done"} {
+			chunk, _ := json.Marshal(map[string]any{
+				"choices": []any{map[string]any{"delta": map[string]string{"content": v}}},
+			})
+			_, _ = fmt.Fprintf(w, "data: %s\n\n", chunk)
+		}
+
+		_, _ = fmt.Fprint(w, `data: {"choices":[],"usage":{"prompt_tokens":3,"completion_tokens":5}}`+"\n\n")
+		_, _ = fmt.Fprint(w, "data: [DONE]\n\n")
+	})
+
+	mux.HandleFunc("GET /v1/models", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		_, _ = fmt.Fprint(w, `{"object":"list","data":[{"id":"text-model","object":"model"}]}`)
+	})
+
+	mux.HandleFunc("POST /v1/images/generations", func(w http.ResponseWriter, r *http.Request) {
+		var req imageRequest
+
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil || req.Model != "image-model" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"data": []any{map[string]string{"b64_json": base64.StdEncoding.EncodeToString([]byte("png"))}},
+		})
+	})
+
+	s := httptest.NewServer(mux)
+	t.Cleanup(s.Close)
+
+	return s
+}
+
+// validContent accepts a plain prompt, or a prompt followed by the JPEG "jpg".
+func validContent(v any) bool {
+	if _, ok := v.(string); ok {
+		return true
+	}
+
+	raw, _ := json.Marshal(v)
+
+	var parts []contentPart
+
+	err := json.Unmarshal(raw, &parts)
+
+	return err == nil && len(parts) == 2 && parts[0].Type == "text" && parts[1].Type == "image_url" &&
+		parts[1].ImageURL != nil && parts[1].ImageURL.URL == "data:image/jpeg;base64,"+
+		base64.StdEncoding.EncodeToString([]byte("jpg"))
+}
+
+func TestClient(t *testing.T) {
+	t.Parallel()
+
+	s := newStandIn(t)
+
+	temperature := float32(0.5)
+
+	defaults := generation.Defaults{
+		Text:  generation.Options{Model: "text-model", Temperature: &temperature},
+		Image: generation.Options{Model: "image-model"},
+	}
+
+	c := New(Config{s.URL + "/v1/", "secret", defaults})
+
+	err := c.Ping(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var usage generation.Usage
+
+	ctx := generation.WithUsage(context.Background(), usage.Add)
+
+	var progress strings.Builder
+
+	onProgress := func(v string) { progress.WriteString(v) }
+
+	text, err := c.Text(ctx, "hello", generation.Options{}, onProgress)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if text != "Sure! <html><body>hi</body></html> done" || progress.String() != text {
+		t.Errorf("unexpected text %q and progress %q", text, progress.String())
+	}
+
+	doc, err := c.HTML(ctx, "hello", generation.Options{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if doc.FirstChild == nil {
+		t.Error("expected parsed document")
+	}
+
+	v, err := c.PNG(ctx, "hello", generation.Options{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(v) != "png" {
+		t.Errorf("unexpected image %q", v)
+	}
+
+	text, err = c.Vision(ctx, "describe", []byte("jpg"), generation.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if text != "Sure! <html><body>hi</body></html> done" {
+		t.Errorf("unexpected vision response %q", text)
+	}
+
+	want := generation.Usage{InputTokens: 9, OutputTokens: 15, Images: 1}
+	if usage != want {
+		t.Errorf("expected usage %+v, got %+v", want, usage)
+	}
+
+	c = New(Config{s.URL + "/v1", "wrong", defaults})
+
+	_, err = c.Text(context.Background(), "hello", generation.Options{}, nil)
+	if !errors.Is(err, ErrUnexpectedStatus) {
+		t.Errorf("expected ErrUnexpectedStatus, got %v", err)
+	}
+
+	err = c.Ping(context.Background())
+	if !errors.Is(err, ErrUnexpectedStatus) {
+		t.Errorf("expected ErrUnexpectedStatus from Ping, got %v", err)
+	}
+}
@@ -5,9 +5,9 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"regexp"
 	"strconv"
 	"strings"
+	"unicode/utf8"
 
 	"github.com/tdewolff/parse/v2"
 	"github.com/tdewolff/parse/v2/css"
@@ -25,7 +25,7 @@ func CSSSanitizeAndExtractUrls(raw string, urls map[string]struct{}, sanitizeURL
 
 	for {
 		from := input.Offset()
-		token, _ := lexer.Next()
+		token, data := lexer.Next()
 		to := input.Offset()
 
 		if token == css.ErrorToken {
@@ -37,38 +37,76 @@ func CSSSanitizeAndExtractUrls(raw string, urls map[string]struct{}, sanitizeURL
 			return "", fmt.Errorf("lexing css failed: %w", lexer.Err())
 		}
 
-		if token == css.URLToken || token == css.BadURLToken {
+		switch {
+		case token == css.URLToken || token == css.BadURLToken:
 			sb.WriteString(raw[last:from])
 			updated := cssSanitizeURL(raw[from:to], urls, sanitizeURL)
 			sb.WriteString(updated)
 
 			last = to
+		case token == css.FunctionToken && strings.EqualFold(cssUnescape(string(data)), "url("):
+			// browsers read an escaped name such as u\72l( as url(, though the lexer doesn't
+			end, err := cssFunctionEnd(lexer, input)
+			if err != nil {
+				return "", err
+			}
+
+			sb.WriteString(raw[last:from])
+			updated := cssSanitizeURL("url("+raw[to:end], urls, sanitizeURL)
+			sb.WriteString(updated)
+
+			last = end
 		}
 	}
 
 	return sb.String(), nil
 }
 
+// cssFunctionEnd consumes the arguments of a function whose name was just lexed and returns the offset after its
+// closing parenthesis, or the end of the input if there is none.
+func cssFunctionEnd(lexer *css.Lexer, input *parse.Input) (int, error) {
+	level := 1
+
+	for level > 0 {
+		token, _ := lexer.Next()
+
+		switch token { //nolint:exhaustive
+		case css.ErrorToken:
+			if errors.Is(lexer.Err(), io.EOF) {
+				return input.Offset(), nil
+			}
+
+			return 0, fmt.Errorf("lexing css failed: %w", lexer.Err())
+		case css.FunctionToken, css.LeftParenthesisToken:
+			level++
+		case css.RightParenthesisToken:
+			level--
+		}
+	}
+
+	return input.Offset(), nil
+}
+
 //nolint:gochecknoglobals
 var cssSingleQuotedStringReplacer = strings.NewReplacer(
 	`\`, `\\`,
 	`'`, `\'`,
-	"\r", `\r`,
-	"\n", `\n`,
-	"\f", `\f`,
-	"\t", `\t`,
-	"\x00", `\0`,
+	"\r", `\d `,
+	"\n", `\a `,
+	"\f", `\c `,
+	"\t", `\9 `,
+	"\x00", `\fffd `,
 )
 
 //nolint:gochecknoglobals
 var cssDoubleQuotedStringReplacer = strings.NewReplacer(
 	`\`, `\\`,
 	`"`, `\"`,
-	"\r", `\r`,
-	"\n", `\n`,
-	"\f", `\f`,
-	"\t", `\t`,
-	"\x00", `\0`,
+	"\r", `\d `,
+	"\n", `\a `,
+	"\f", `\c `,
+	"\t", `\9 `,
+	"\x00", `\fffd `,
 )
 
 //nolint:gochecknoglobals
@@ -79,19 +117,21 @@ var cssUnquotedURLReplacer = strings.NewReplacer(
 	`(`, `\(`,
 	`)`, `\)`,
 	" ", `\ `,
-	"\r", `\r`,
-	"\n", `\n`,
-	"\f", `\f`,
-	"\t", `\t`,
-	"\x00", `\0`,
+	"\r", `\d `,
+	"\n", `\a `,
+	"\f", `\c `,
+	"\t", `\9 `,
+	"\x00", `\fffd `,
 )
 
 func cssSanitizeURL(raw string, urls map[string]struct{}, sanitizeURL func(string) string) string {
-	if len(raw) < len("url()") || !strings.EqualFold(raw[:len("url(")], "url(") || raw[len(raw)-1] != ')' {
+	name, value, ok := strings.Cut(raw, "(")
+	if !ok || !strings.EqualFold(cssUnescape(name), "url") {
 		return raw
 	}
 
-	raw = raw[len("url(") : len(raw)-1]
+	// browsers still load a url left open at the end of a style sheet or attribute
+	raw = strings.TrimSuffix(value, ")")
 	raw = strings.TrimSpace(raw)
 
 	if raw == "" {
@@ -142,62 +182,69 @@ func cssSanitizeURL(raw string, urls map[string]struct{}, sanitizeURL func(strin
 	return sanitized
 }
 
-var cssUnescapeRe = regexp.MustCompile(`\\([0-9a-fA-F]{1,6}) ?`)
-
+// cssUnescape resolves escapes as browsers do. A backslash followed by up to six hex digits, and optionally a
+// whitespace character, is that code point. A backslash before a newline is removed, and before anything else it is
+// that character.
+//
 //nolint:cyclop
 func cssUnescape(input string) string {
-	v := cssUnescapeRe.ReplaceAllStringFunc(input, func(match string) string {
-		hex := strings.TrimSpace(match[1:])
-
-		code, err := strconv.ParseInt(hex, 16, 32)
-		if err != nil {
-			return match
-		}
-
-		return string(rune(code))
-	})
+	const maxHexDigits = 6
 
 	var sb strings.Builder
-	escaped := false
-
-	for _, r := range v {
-		if !escaped {
-			if r == '\\' {
-				escaped = true
-				continue
-			}
 
+	for i := 0; i < len(input); {
+		if input[i] != '\\' {
+			r, size := utf8.DecodeRuneInString(input[i:])
 			sb.WriteRune(r)
+			i += size
 
 			continue
 		}
 
-		switch r {
-		case '\r':
-			continue
-		case '\n', '\f':
-			escaped = false
-			continue
-		case 'n':
-			sb.WriteRune('\n')
-		case 'r':
-			sb.WriteRune('\r')
-		case 't':
-			sb.WriteRune('\t')
-		case 'f':
-			sb.WriteRune('\f')
-		case '\\':
-			sb.WriteRune('\\')
-		default:
-			sb.WriteRune(r)
+		i++
+
+		digits := 0
+		for digits < maxHexDigits && i+digits < len(input) && isHexDigit(input[i+digits]) {
+			digits++
 		}
 
-		escaped = false
-	}
+		switch {
+		case digits > 0:
+			code, _ := strconv.ParseUint(input[i:i+digits], 16, 32)
+			if code == 0 {
+				code = utf8.RuneError
+			}
 
-	if escaped {
-		sb.WriteByte('\\')
+			sb.WriteRune(rune(code))
+
+			i += digits
+			i += cssWhitespaceLength(input[i:])
+		case i == len(input):
+			sb.WriteByte('\\')
+		case input[i] == '\n' || input[i] == '\r' || input[i] == '\f':
+			i += cssWhitespaceLength(input[i:])
+		default:
+			r, size := utf8.DecodeRuneInString(input[i:])
+			sb.WriteRune(r)
+			i += size
+		}
 	}
 
 	return sb.String()
 }
+
+func isHexDigit(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
+}
+
+// cssWhitespaceLength returns the length of the whitespace character v starts with, counting \r\n as one, or zero.
+func cssWhitespaceLength(v string) int {
+	switch {
+	case strings.HasPrefix(v, "\r\n"):
+		return len("\r\n")
+	case v != "" && strings.IndexByte(" \t\n\r\f", v[0]) >= 0:
+		return 1
+	default:
+		return 0
+	}
+}
@@ -0,0 +1,404 @@
+package sanitize
+
+import (
+	"bytes"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/tdewolff/parse/v2"
+	"github.com/tdewolff/parse/v2/css"
+)
+
+// CSSPolicy limits what style sheets and style attributes may do. It works alongside CSSSanitizeAndExtractUrls,
+// which takes care of url() tokens. Names are in lower case.
+type CSSPolicy struct {
+	// AtRules are the at-rules allowed. Others are removed along with their blocks, as are blocks of at-rules whose
+	// contents can't be checked.
+	AtRules []string
+	// Functions are removed along with the declarations or at-rules that use them.
+	Functions []string
+	// Properties are removed wherever they appear.
+	Properties []string
+	// Values maps properties to values they may not have, such as fixed for position.
+	Values map[string][]string
+	// MaxZIndex is the largest z-index kept so nothing can be stacked above overlays such as the banner.
+	MaxZIndex int
+	// RootProperties are removed from rules that may apply to the html or body elements, since through those every
+	// element on the page can be hidden or moved.
+	RootProperties []string
+	// Reserved are elements pages may not contain but ginprov adds, such as the banner's iframe. Rules that select
+	// them by name can only apply to what ginprov added, so all of their declarations are removed.
+	Reserved []string
+}
+
+// DefaultCSSPolicy keeps ordinary styling but removes imports, scripting and binding through CSS, ways to load
+// resources that bypass url(), and anything that could cover, hide or move the banner ginprov adds to pages. Each
+// call returns a new CSSPolicy that can be changed freely.
+func DefaultCSSPolicy() *CSSPolicy {
+	const maxZIndex = 99999
+
+	return &CSSPolicy{
+		[]string{"media", "supports", "keyframes", "font-face", "page"},
+		[]string{
+			"expression", "image-set", "-webkit-image-set", "cross-fade", "-webkit-cross-fade", "element",
+			"-moz-element", "src", "paint",
+		},
+		[]string{"behavior", "-ms-behavior", "-moz-binding", "-ms-filter"},
+		map[string][]string{"position": {"fixed"}},
+		maxZIndex,
+		[]string{
+			"display", "visibility", "opacity", "transform", "translate", "rotate", "scale", "filter",
+			"backdrop-filter", "clip", "clip-path", "mask", "mask-image", "zoom", "perspective", "contain",
+			"content-visibility", "will-change", "isolation", "mix-blend-mode", "z-index", "animation",
+			"animation-name",
+		},
+		[]string{"iframe"},
+	}
+}
+
+// cssRoots are the classes and ids carried by the html and body elements, which tell which rules may apply to them.
+type cssRoots struct {
+	classes []string
+	ids     []string
+}
+
+// cssAtRulesChecked are the at-rules whose blocks the parser breaks into rules and declarations. Blocks of other
+// at-rules are passed through as tokens so cannot be checked.
+//
+//nolint:gochecknoglobals
+var cssAtRulesChecked = []string{"media", "supports", "document", "keyframes", "font-face", "page"}
+
+// filterStyleSheet removes what p does not allow from a style sheet, keeping everything else as written. Anything
+// after a parse error is removed since browsers may not read it as the parser did.
+//
+//nolint:cyclop,gocognit
+func (p *CSSPolicy) filterStyleSheet(raw string, roots cssRoots) string {
+	input := parse.NewInput(bytes.NewBufferString(raw))
+	parser := css.NewParser(input, false)
+
+	var sb strings.Builder
+
+	var selectors [][]css.Token
+
+	var keyframes []bool
+
+	last := 0
+	skip := 0
+	root := false
+	reserved := false
+
+	for {
+		gt, _, data := parser.Next()
+		if gt == css.ErrorGrammar || parser.Offset() < last {
+			break
+		}
+
+		span := raw[last:parser.Offset()]
+		last = parser.Offset()
+
+		if skip > 0 {
+			switch gt { //nolint:exhaustive
+			case css.BeginAtRuleGrammar, css.BeginRulesetGrammar:
+				skip++
+			case css.EndAtRuleGrammar, css.EndRulesetGrammar:
+				skip--
+			}
+
+			continue
+		}
+
+		switch gt { //nolint:exhaustive
+		case css.CommentGrammar, css.EndRulesetGrammar:
+			sb.WriteString(span)
+		case css.AtRuleGrammar:
+			if p.allowsAtRule(string(data)) && !p.usesFunction(span) {
+				sb.WriteString(span)
+			} else {
+				writeEnd(&sb, span)
+			}
+		case css.BeginAtRuleGrammar:
+			name := atRuleName(string(data))
+			if !p.allowsAtRule(string(data)) || !slices.Contains(cssAtRulesChecked, name) || p.usesFunction(span) {
+				skip = 1
+				continue
+			}
+
+			keyframes = append(keyframes, name == "keyframes")
+
+			sb.WriteString(span)
+		case css.EndAtRuleGrammar:
+			if len(keyframes) > 0 {
+				keyframes = keyframes[:len(keyframes)-1]
+			}
+
+			sb.WriteString(span)
+		case css.QualifiedRuleGrammar:
+			selectors = append(selectors, slices.Clone(parser.Values()))
+
+			sb.WriteString(span)
+		case css.BeginRulesetGrammar:
+			selectors = append(selectors, slices.Clone(parser.Values()))
+
+			inKeyframes := len(keyframes) > 0 && keyframes[len(keyframes)-1]
+			root = !inKeyframes && slices.ContainsFunc(selectors, func(v []css.Token) bool {
+				return mayMatchRoot(v, roots)
+			})
+			reserved = !inKeyframes && slices.ContainsFunc(selectors, p.selectsReserved)
+			selectors = selectors[:0]
+
+			sb.WriteString(span)
+		case css.DeclarationGrammar, css.CustomPropertyGrammar:
+			if !reserved && p.allowsDeclaration(string(data), parser.Values(), span, root) {
+				sb.WriteString(span)
+			} else {
+				writeEnd(&sb, span)
+			}
+		}
+	}
+
+	if strings.TrimSpace(raw[last:]) == "" {
+		sb.WriteString(raw[last:])
+	}
+
+	return sb.String()
+}
+
+// filterDeclarations removes what p does not allow from the declarations of a style attribute. Root is whether the
+// attribute is on the html or body element.
+func (p *CSSPolicy) filterDeclarations(raw string, root bool) string {
+	input := parse.NewInput(bytes.NewBufferString(raw))
+	parser := css.NewParser(input, true)
+
+	var sb strings.Builder
+
+	last := 0
+
+	for {
+		gt, _, data := parser.Next()
+		if gt == css.ErrorGrammar || parser.Offset() < last {
+			break
+		}
+
+		span := raw[last:parser.Offset()]
+		last = parser.Offset()
+
+		if (gt == css.DeclarationGrammar || gt == css.CustomPropertyGrammar) &&
+			p.allowsDeclaration(string(data), parser.Values(), span, root) {
+			sb.WriteString(span)
+		}
+	}
+
+	return sb.String()
+}
+
+// writeEnd writes the closing brace that ends span, if any, so removing span leaves blocks balanced.
+func writeEnd(sb *strings.Builder, span string) {
+	if strings.HasSuffix(span, "}") {
+		sb.WriteByte('}')
+	}
+}
+
+func (p *CSSPolicy) allowsAtRule(keyword string) bool {
+	return slices.Contains(p.AtRules, atRuleName(keyword))
+}
+
+// atRuleName returns the name of an at-rule without its @ or any vendor prefix.
+func atRuleName(keyword string) string {
+	return unprefixed(strings.ToLower(cssUnescape(strings.TrimPrefix(keyword, "@"))))
+}
+
+//nolint:cyclop
+func (p *CSSPolicy) allowsDeclaration(property string, values []css.Token, span string, root bool) bool {
+	if p.usesFunction(span) {
+		return false
+	}
+
+	name := strings.ToLower(cssUnescape(property))
+	if strings.HasPrefix(name, "--") {
+		return true
+	}
+
+	if matchesProperty(p.Properties, name) || root && matchesProperty(p.RootProperties, name) {
+		return false
+	}
+
+	disallowed, constrained := p.Values[unprefixed(name)]
+	zIndex := unprefixed(name) == "z-index" && p.MaxZIndex > 0
+
+	if !constrained && !zIndex {
+		return true
+	}
+
+	// the value of a custom property can't be checked where it is used
+	if usesFunctionNamed(span, "var", "attr", "env") {
+		return false
+	}
+
+	value := declarationValue(values)
+
+	if constrained && slices.Contains(disallowed, value) {
+		return false
+	}
+
+	if zIndex {
+		return p.allowsZIndex(value)
+	}
+
+	return true
+}
+
+// allowsZIndex keeps keywords such as auto and integers up to MaxZIndex. Anything else, like calc(), could exceed it.
+func (p *CSSPolicy) allowsZIndex(value string) bool {
+	n, err := strconv.Atoi(value)
+	if err == nil {
+		return n <= p.MaxZIndex
+	}
+
+	return slices.Contains([]string{"auto", "inherit", "initial", "unset", "revert", "revert-layer"}, value)
+}
+
+// declarationValue returns a single-token value in lower case and without !important.
+func declarationValue(values []css.Token) string {
+	var sb strings.Builder
+
+	for _, v := range values {
+		if v.TokenType == css.DelimToken && string(v.Data) == "!" {
+			break
+		}
+
+		if v.TokenType != css.WhitespaceToken {
+			sb.Write(v.Data)
+		}
+	}
+
+	return strings.ToLower(cssUnescape(sb.String()))
+}
+
+func (p *CSSPolicy) usesFunction(span string) bool {
+	return usesFunctionNamed(span, p.Functions...)
+}
+
+// usesFunctionNamed reports whether any of the functions named appear in css.
+func usesFunctionNamed(raw string, names ...string) bool {
+	lexer := css.NewLexer(parse.NewInput(bytes.NewBufferString(raw)))
+
+	for {
+		token, data := lexer.Next()
+		if token == css.ErrorToken {
+			return false
+		}
+
+		if token == css.FunctionToken {
+			name := strings.ToLower(cssUnescape(strings.TrimSuffix(string(data), "(")))
+			if slices.Contains(names, name) {
+				return true
+			}
+		}
+	}
+}
+
+func matchesProperty(properties []string, name string) bool {
+	return slices.Contains(properties, name) || slices.Contains(properties, unprefixed(name))
+}
+
+// unprefixed removes a vendor prefix such as -webkit- from name.
+func unprefixed(name string) string {
+	if !strings.HasPrefix(name, "-") || strings.HasPrefix(name, "--") {
+		return name
+	}
+
+	i := strings.IndexByte(name[1:], '-')
+	if i < 0 {
+		return name
+	}
+
+	return name[i+2:]
+}
+
+// mayMatchRoot reports whether a selector could apply to the html or body element. Only the last compound selector
+// matters. It cannot match if it names another element, or a class or id neither of them has.
+func mayMatchRoot(selector []css.Token, roots cssRoots) bool {
+	compound := selector[lastCompound(selector):]
+	level := 0
+
+	for i, v := range compound {
+		level += nesting(v)
+		if level > 0 {
+			continue
+		}
+
+		data := cssUnescape(string(v.Data))
+
+		if v.TokenType == css.IdentToken && i == 0 && !slices.Contains([]string{"html", "body"}, strings.ToLower(data)) {
+			return false
+		}
+
+		if v.TokenType == css.IdentToken && i > 0 && isDelim(compound[i-1], ".") && !slices.Contains(roots.classes, data) {
+			return false
+		}
+
+		if v.TokenType == css.HashToken && !slices.Contains(roots.ids, strings.TrimPrefix(data, "#")) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// selectsReserved reports whether the last compound selector of selector names one of p.Reserved, including within
+// pseudo-classes such as :is().
+func (p *CSSPolicy) selectsReserved(selector []css.Token) bool {
+	compound := selector[lastCompound(selector):]
+
+	for i, v := range compound {
+		if v.TokenType != css.IdentToken {
+			continue
+		}
+
+		// class names and pseudo-classes
+		if i > 0 && (isDelim(compound[i-1], ".") || compound[i-1].TokenType == css.ColonToken) {
+			continue
+		}
+
+		if slices.Contains(p.Reserved, strings.ToLower(cssUnescape(string(v.Data)))) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// lastCompound returns where the compound selector after the last combinator starts.
+func lastCompound(selector []css.Token) int {
+	start := 0
+	level := 0
+
+	for i, v := range selector {
+		level += nesting(v)
+
+		if level == 0 && (v.TokenType == css.WhitespaceToken || isDelim(v, ">") || isDelim(v, "+") || isDelim(v, "~")) {
+			start = i + 1
+		}
+	}
+
+	return start
+}
+
+// nesting returns how v changes the depth of parentheses and brackets.
+func nesting(v css.Token) int {
+	if v.TokenType == css.FunctionToken || v.TokenType == css.LeftParenthesisToken ||
+		v.TokenType == css.LeftBracketToken {
+		return 1
+	}
+
+	if v.TokenType == css.RightParenthesisToken || v.TokenType == css.RightBracketToken {
+		return -1
+	}
+
+	return 0
+}
+
+func isDelim(v css.Token, delim string) bool {
+	return v.TokenType == css.DelimToken && string(v.Data) == delim
+}
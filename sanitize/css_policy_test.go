@@ -0,0 +1,96 @@
+package sanitize
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/html"
+)
+
+func TestCSSPolicyStyleSheet(t *testing.T) {
+	t.Parallel()
+
+	roots := cssRoots{[]string{"dark"}, []string{"top"}}
+
+	tests := []struct {
+		name     string
+		input    string
+		expected string
+	}{
+		{"ordinary", "p { color: red; }\n.a > b:hover { margin: 0 }", "p { color: red; }\n.a > b:hover { margin: 0 }"},
+		{"import", "@import url(evil.css);\n@import 'x.css';\np { color: red }", "\np { color: red }"},
+		{"expression", "p { width: expression(alert(1)); color: red }", "p { color: red }"},
+		{"behavior and binding", "p { behavior: url(x.htc); -moz-binding: url(x.xml#x); color: red }", "p { color: red }"},
+		{"image-set", `p { background: image-set("x.png" 1x); color: red }`, "p { color: red }"},
+		{"escaped names", `p { posit\69 on: fixed; width: expr\65 ssion(alert(1)) }`, "p {}"},
+		{"position", "p { position: fixed; } q { position: sticky; top: 0 }", "p { } q { position: sticky; top: 0 }"},
+		{"position with var", "p { --p: fixed; position: var(--p) }", "p { --p: fixed;}"},
+		{"z-index", "p { z-index: 10 } q { z-index: 9999999 } s { z-index: calc(9999999) }", "p { z-index: 10 } q {} s {}"},
+		{"media", "@media (min-width: 1px) { p { position: fixed; color: red } }",
+			"@media (min-width: 1px) { p { color: red } }"},
+		{"unchecked block", "@layer a { body { display: none } }\np { color: red }", "\np { color: red }"},
+		{"root", "body { opacity: 0; color: red } html, p { transform: scale(0) }", "body { color: red } html, p {}"},
+		{"root prefixed", "body { -webkit-transform: scale(0); -webkit-filter: blur(9px) }", "body {}"},
+		{"universal", "* { visibility: hidden } p * { visibility: hidden }", "* {} p * {}"},
+		{"root class and id", ".dark { display: none } #top { display: none } .card { display: none }",
+			".dark {} #top {} .card { display: none }"},
+		{"other elements", "p, .card:hover, main > section { opacity: 0.5 }",
+			"p, .card:hover, main > section { opacity: 0.5 }"},
+		{"keyframes", "@keyframes fade { to { opacity: 0 } }", "@keyframes fade { to { opacity: 0 } }"},
+		{"root animation", "body { animation: fade 1s }", "body {}"},
+		{"banner scale", "iframe{scale:0 !important}", "iframe{}"},
+		{"banner translate", "iframe{translate:0 -500px !important}", "iframe{}"},
+		{"banner zoom", "iframe{zoom:0.01 !important}", "iframe{}"},
+		{"banner max-height", "iframe{max-height:0 !important}", "iframe{}"},
+		{"banner margin", "iframe{margin-top:-200px !important}", "iframe{}"},
+		{"banner in a list", "p, body > IFRAME { color: red } :is(iframe) { margin: 0 }",
+			"p, body > IFRAME {} :is(iframe) {}"},
+		{"banner by attribute", "[src] { scale: 0; color: red }", "[src] { color: red }"},
+		{"not the banner", ".iframe, iframe + p, p:not(iframe) x { margin: 0 }",
+			".iframe, iframe + p, p:not(iframe) x { margin: 0 }"},
+		{"parse error", "p { color: red } q { ) } s { position: fixed }", "p { color: red } q {"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			got := DefaultCSSPolicy().filterStyleSheet(tt.input, roots)
+			if got != tt.expected {
+				t.Errorf("expected %q, got %q", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestCSSPolicyStyleAttributes(t *testing.T) {
+	t.Parallel()
+
+	const input = `<html class="dark"><head><style>.dark { opacity: 0 } .card { opacity: 0.5 }</style></head>` +
+		`<body style="display: none; color: red"><div style="position: fixed; display: none; z-index: 1000000">` +
+		`</div></body></html>`
+
+	doc, err := html.Parse(strings.NewReader(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = HTMLSanitizeWithPolicy(doc, DefaultPolicy())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+
+	err = html.Render(&buf, doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := `<html class="dark"><head><style>.dark {} .card { opacity: 0.5 }</style></head>` +
+		`<body style=" color: red"><div style=" display: none;"></div></body></html>`
+	if buf.String() != want {
+		t.Errorf("expected\n%s\ngot\n%s", want, buf.String())
+	}
+}
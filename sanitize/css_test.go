@@ -0,0 +1,201 @@
+package sanitize
+
+import (
+	"bytes"
+	"maps"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/tdewolff/parse/v2"
+	"github.com/tdewolff/parse/v2/css"
+)
+
+func TestCSSUnescape(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name     string
+		input    string
+		expected string
+	}{
+		{"plain", "a.png", "a.png"},
+		{"hex", `\41 B`, "AB"},
+		{"hex without space", `\72l`, "rl"},
+		{"six digits", `\000041B`, "AB"},
+		{"character", `\(a\)`, "(a)"},
+		{"not hex", `a\nb\rc`, "anbrc"},
+		{"escaped backslash", `a\\b`, `a\b`},
+		{"whitespace after hex", "\\41\tB\\41\r\nC", "ABAC"},
+		{"null", `\0 a`, "\uFFFDa"},
+		{"line continuation", "a\\\nb", "ab"},
+		{"trailing", `a\`, `a\`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			got := cssUnescape(tt.input)
+			if got != tt.expected {
+				t.Errorf("expected %q, got %q", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestCSSSanitizeAndExtractUrls(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name     string
+		input    string
+		expected string
+		urls     []string
+	}{
+		{"unquoted", "a { b: url(x.png) }", "a { b: url(X\\(x.png\\)) }", []string{"X(x.png)"}},
+		{"single quoted", `a { b: url( 'x\'.png' ) }`, `a { b: url('X(x\'.png)') }`, []string{"X(x'.png)"}},
+		{"double quoted", `a { b: url("x.png") }`, `a { b: url("X(x.png)") }`, []string{"X(x.png)"}},
+		{"upper case", "a { b: URL(x.png) }", "a { b: url(X\\(x.png\\)) }", []string{"X(x.png)"}},
+		{"empty", "a { b: url() }", "a { b: url() }", nil},
+		{"bad", "a { b: url(x y.png) }", "a { b: url(X\\(x\\ y.png\\)) }", []string{"X(x y.png)"}},
+		{"unclosed", "a { b: url(http://e/x.png", "a { b: url(X\\(http://e/x.png\\))", []string{"X(http://e/x.png)"}},
+		{"escaped name", `a { b: u\72l(x.png) }`, "a { b: url(X\\(x.png\\)) }", []string{"X(x.png)"}},
+		{"escaped name quoted", `a { b: \75 rl("x.png") c }`, `a { b: url("X(x.png)") c }`, []string{"X(x.png)"}},
+		{"escaped name unclosed", `a { b: u\rl(x.png`, "a { b: url(X\\(x.png\\))", []string{"X(x.png)"}},
+		{"escaped name closed", `a { b: u\rl(x.png) }`, "a { b: url(X\\(x.png\\)) }", []string{"X(x.png)"}},
+		{"escaped newline", `a { b: url("x\a y") }`, `a { b: url("X(x\a y)") }`, []string{"X(x\ny)"}},
+		{"escaped tab unquoted", `a { b: url(x\9 y) }`, "a { b: url(X\\(x\\9 y\\)) }", []string{"X(x\ty)"}},
+		{"other function", "a { b: calc(1px) }", "a { b: calc(1px) }", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			urls := make(map[string]struct{})
+
+			got, err := CSSSanitizeAndExtractUrls(tt.input, urls, func(u string) string { return "X(" + u + ")" })
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got != tt.expected {
+				t.Errorf("expected %q, got %q", tt.expected, got)
+			}
+
+			want := make(map[string]struct{})
+			for _, u := range tt.urls {
+				want[u] = struct{}{}
+			}
+
+			if !maps.Equal(urls, want) {
+				t.Errorf("expected urls %v, got %v", tt.urls, urls)
+			}
+		})
+	}
+}
+
+// FuzzCSSSanitizeAndExtractUrls checks that nothing a browser would load survives sanitization, and that sanitizing
+// again finds exactly the URLs recorded the first time.
+func FuzzCSSSanitizeAndExtractUrls(f *testing.F) {
+	f.Fuzz(func(t *testing.T, raw string) {
+		urls := make(map[string]struct{})
+
+		out, err := CSSSanitizeAndExtractUrls(raw, urls, fuzzSanitizeURL)
+		if err != nil {
+			return
+		}
+
+		checkURLs(t, urls)
+		checkCSS(t, out, urls)
+
+		again := make(map[string]struct{})
+
+		_, err = CSSSanitizeAndExtractUrls(out, again, func(u string) string { return u })
+		if err != nil {
+			t.Fatalf("sanitized css %q no longer lexes: %v", out, err)
+		}
+
+		if !maps.Equal(urls, again) {
+			t.Errorf("sanitized css %q has urls %v, expected %v", out, again, urls)
+		}
+	})
+}
+
+// fuzzSanitizeURL stands in for the server's sanitizeURL, which this package can't import. Like it, it returns
+// "data:" or a lower-case slug ending in .html or .jpg.
+func fuzzSanitizeURL(v string) string {
+	v = strings.ToLower(v)
+	ext := ""
+
+	if i := strings.LastIndexByte(v, '.'); i >= 0 {
+		v, ext = v[:i], v[i:]
+	}
+
+	slug := strings.Trim(regexp.MustCompile(`[^a-z0-9]`).ReplaceAllString(v, "-"), "-")
+	if slug == "" {
+		slug = "index"
+	}
+
+	switch ext {
+	case ".jpg", ".png":
+		return slug + ".jpg"
+	case "", ".html":
+		return slug + ".html"
+	default:
+		return "data:"
+	}
+}
+
+// checkURLs fails unless every URL is "data:" or a slug.
+func checkURLs(t *testing.T, urls map[string]struct{}) {
+	t.Helper()
+
+	slug := regexp.MustCompile(`^[a-z0-9]+(-+[a-z0-9]+)*\.(html|jpg)$`)
+
+	for u := range urls {
+		if u != "data:" && !slug.MatchString(u) {
+			t.Errorf("unexpected url %q", u)
+		}
+	}
+}
+
+// checkCSS fails if raw could load anything but the recorded urls. It finds URLs separately from
+// CSSSanitizeAndExtractUrls so a mistake in one shows up as a difference from the other.
+func checkCSS(t *testing.T, raw string, urls map[string]struct{}) {
+	t.Helper()
+
+	lexer := css.NewLexer(parse.NewInput(bytes.NewBufferString(raw)))
+
+	for {
+		token, data := lexer.Next()
+
+		switch token { //nolint:exhaustive
+		case css.ErrorToken:
+			return
+		case css.URLToken, css.BadURLToken:
+			name, v, _ := strings.Cut(string(data), "(")
+			if !strings.EqualFold(cssUnescape(name), "url") {
+				continue
+			}
+
+			v = strings.TrimSuffix(v, ")")
+			v = strings.TrimSpace(v)
+
+			if len(v) >= 2 && (v[0] == '"' || v[0] == '\'') && v[len(v)-1] == v[0] {
+				v = v[1 : len(v)-1]
+			}
+
+			v = cssUnescape(v)
+
+			if _, ok := urls[v]; !ok && v != "" {
+				t.Errorf("unrecorded url %q in %q", v, raw)
+			}
+		case css.FunctionToken:
+			if strings.EqualFold(cssUnescape(string(data)), "url(") {
+				t.Errorf("url function %q left in %q", data, raw)
+			}
+		}
+	}
+}
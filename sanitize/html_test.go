@@ -2,6 +2,7 @@ package sanitize
 
 import (
 	"bytes"
+	"maps"
 	"strings"
 	"testing"
 
@@ -183,6 +184,70 @@ func TestHTMLSanitizeElements(t *testing.T) {
 	}
 }
 
+// FuzzHTMLSanitizeAndExtractUrls checks that every URL left in a page is one that was recorded, and that parsing and
+// sanitizing the rendered page again finds exactly the same URLs.
+func FuzzHTMLSanitizeAndExtractUrls(f *testing.F) {
+	f.Fuzz(func(t *testing.T, raw string) {
+		doc, err := html.Parse(strings.NewReader(raw))
+		if err != nil {
+			return
+		}
+
+		urls := make(map[string]struct{})
+
+		err = HTMLSanitizeAndExtractUrls(doc, urls, fuzzSanitizeURL)
+		if err != nil {
+			return
+		}
+
+		checkURLs(t, urls)
+
+		var buf bytes.Buffer
+
+		err = html.Render(&buf, doc)
+		if err != nil {
+			return
+		}
+
+		doc, err = html.Parse(&buf)
+		if err != nil {
+			t.Fatalf("failed to re-parse sanitized html: %v", err)
+		}
+
+		walkCSS(doc, func(v string) { checkCSS(t, v, urls) })
+
+		again := make(map[string]struct{})
+
+		err = HTMLSanitizeAndExtractUrls(doc, again, func(u string) string { return u })
+		if err != nil {
+			t.Fatalf("failed to sanitize re-parsed html: %v", err)
+		}
+
+		if !maps.Equal(urls, again) {
+			t.Errorf("re-parsed html %q has urls %v, expected %v", buf.String(), again, urls)
+		}
+	})
+}
+
+// walkCSS calls f with every style attribute and the contents of every <style> element under n.
+func walkCSS(n *html.Node, f func(string)) {
+	if n.Type == html.ElementNode {
+		for _, a := range n.Attr {
+			if strings.EqualFold(a.Key, "style") {
+				f(a.Val)
+			}
+		}
+
+		if n.Data == "style" && n.FirstChild != nil && n.FirstChild.Type == html.TextNode {
+			f(n.FirstChild.Data)
+		}
+	}
+
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		walkCSS(c, f)
+	}
+}
+
 func findNode(n *html.Node, selector string) *html.Node {
 	var walk func(*html.Node) *html.Node
 	walk = func(n *html.Node) *html.Node {
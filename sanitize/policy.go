@@ -0,0 +1,238 @@
+package sanitize
+
+import (
+	"slices"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// Policy is an allowlist of the elements and attributes generated HTML may contain. Names are in lower case.
+type Policy struct {
+	// Elements maps each allowed element to the attributes allowed on it besides Attributes.
+	Elements map[string][]string
+	// Attributes are allowed on every allowed element.
+	Attributes []string
+	// AttributePrefixes allow every attribute that starts with one of them, such as "data-".
+	AttributePrefixes []string
+	// Drop lists elements that are removed along with everything inside them. Other elements that are not allowed
+	// are replaced by their children so their text survives.
+	Drop []string
+	// CSS limits what <style> elements and style attributes may do. Nil allows any CSS.
+	CSS *CSSPolicy
+}
+
+// DefaultPolicy allows the structure, text, tables, forms and images of an ordinary page, with styles limited by
+// DefaultCSSPolicy. Scripts, event handlers, plugins, frames, SVG and MathML are removed, as are <base> and
+// <meta http-equiv>. Each call returns a new Policy that can be changed freely.
+func DefaultPolicy() *Policy {
+	elements := map[string][]string{
+		"style":      {"media"},
+		"meta":       {"name", "content", "charset", "property"},
+		"a":          {"href", "target", "rel", "hreflang", "download"},
+		"img":        {"src", "srcset", "sizes", "alt", "width", "height", "loading", "decoding"},
+		"source":     {"srcset", "sizes", "type", "media"},
+		"ol":         {"start", "type", "reversed"},
+		"li":         {"value"},
+		"blockquote": {"cite"},
+		"q":          {"cite"},
+		"del":        {"cite", "datetime"},
+		"ins":        {"cite", "datetime"},
+		"time":       {"datetime"},
+		"data":       {"value"},
+		"details":    {"open"},
+		"colgroup":   {"span"},
+		"col":        {"span"},
+		"th":         {"colspan", "rowspan", "scope", "headers"},
+		"td":         {"colspan", "rowspan", "headers"},
+		"form":       {"action", "method", "name", "autocomplete"},
+		"fieldset":   {"name", "disabled"},
+		"label":      {"for"},
+		"input": {
+			"type", "name", "value", "placeholder", "checked", "disabled", "readonly", "required", "min", "max",
+			"step", "minlength", "maxlength", "size", "pattern", "autocomplete", "list", "multiple",
+		},
+		"button":   {"type", "name", "value", "disabled"},
+		"select":   {"name", "multiple", "size", "disabled", "required"},
+		"option":   {"value", "selected", "disabled", "label"},
+		"optgroup": {"label", "disabled"},
+		"textarea": {"name", "rows", "cols", "placeholder", "disabled", "readonly", "required", "maxlength"},
+		"meter":    {"value", "min", "max", "low", "high", "optimum"},
+		"progress": {"value", "max"},
+		"output":   {"for", "name"},
+	}
+
+	for _, name := range []string{
+		"html", "head", "body", "title", "header", "footer", "main", "nav", "section", "article", "aside",
+		"address", "div", "span", "p", "br", "hr", "wbr", "h1", "h2", "h3", "h4", "h5", "h6", "hgroup", "ul",
+		"dl", "dt", "dd", "pre", "code", "kbd", "samp", "var", "em", "strong", "b", "i", "u", "s", "small", "sub",
+		"sup", "mark", "abbr", "cite", "dfn", "bdi", "bdo", "ruby", "rt", "rp", "summary", "figure", "figcaption",
+		"picture", "table", "caption", "thead", "tbody", "tfoot", "tr", "legend", "datalist",
+	} {
+		elements[name] = nil
+	}
+
+	return &Policy{
+		elements,
+		[]string{"id", "class", "style", "title", "lang", "dir", "hidden", "tabindex", "role", "translate"},
+		[]string{"data-", "aria-"},
+		[]string{
+			"script", "noscript", "template", "iframe", "frame", "frameset", "object", "embed", "applet", "param",
+			"base", "link", "svg", "math", "xmp", "plaintext", "noembed", "noframes", "portal", "audio", "video",
+			"canvas", "dialog",
+		},
+		DefaultCSSPolicy(),
+	}
+}
+
+// HTMLSanitizeWithPolicy removes everything from doc that policy does not allow. Comments are removed too.
+func HTMLSanitizeWithPolicy(doc *html.Node, policy *Policy) error {
+	roots := findRoots(doc)
+
+	var walk func(*html.Node, int) error
+	walk = func(n *html.Node, depth int) error {
+		if depth > maxDepth {
+			return ErrMaxDepthExceeded
+		}
+
+		for c := n.FirstChild; c != nil; {
+			next := c.NextSibling
+
+			switch c.Type {
+			case html.CommentNode:
+				n.RemoveChild(c)
+			case html.ElementNode:
+				err := walk(c, depth+1)
+				if err != nil {
+					return err
+				}
+
+				name := strings.ToLower(c.Data)
+
+				allowed, ok := policy.Elements[name]
+
+				switch {
+				case ok && c.Namespace == "":
+					c.Attr = policy.filterAttributes(c.Attr, allowed)
+					policy.filterCSS(c, name, roots)
+				case c.Namespace != "" || slices.Contains(policy.Drop, name):
+					n.RemoveChild(c)
+				default:
+					unwrap(c)
+				}
+			case html.DocumentNode, html.DoctypeNode, html.TextNode, html.ErrorNode, html.RawNode:
+				err := walk(c, depth+1)
+				if err != nil {
+					return err
+				}
+			}
+
+			c = next
+		}
+
+		return nil
+	}
+
+	return walk(doc, 0)
+}
+
+func (p *Policy) filterAttributes(attrs []html.Attribute, allowed []string) []html.Attribute {
+	return slices.DeleteFunc(attrs, func(a html.Attribute) bool {
+		if a.Namespace != "" {
+			return true
+		}
+
+		key := strings.ToLower(a.Key)
+
+		if slices.Contains(p.Attributes, key) || slices.Contains(allowed, key) {
+			return false
+		}
+
+		for _, prefix := range p.AttributePrefixes {
+			if strings.HasPrefix(key, prefix) {
+				return false
+			}
+		}
+
+		return true
+	})
+}
+
+// filterCSS applies p.CSS to the style attribute of n and, if n is a <style> element, to its contents.
+func (p *Policy) filterCSS(n *html.Node, name string, roots cssRoots) {
+	if p.CSS == nil {
+		return
+	}
+
+	root := name == "html" || name == "body"
+
+	for i := range n.Attr {
+		if strings.ToLower(n.Attr[i].Key) == "style" {
+			n.Attr[i].Val = p.CSS.filterDeclarations(n.Attr[i].Val, root)
+		}
+	}
+
+	if name != "style" {
+		return
+	}
+
+	var sb strings.Builder
+
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if c.Type == html.TextNode {
+			sb.WriteString(c.Data)
+		}
+	}
+
+	for n.FirstChild != nil {
+		n.RemoveChild(n.FirstChild)
+	}
+
+	n.AppendChild(&html.Node{
+		Type: html.TextNode,
+		Data: p.CSS.filterStyleSheet(sb.String(), roots),
+	})
+}
+
+// findRoots collects the classes and ids of the html and body elements, which are always near the top of the tree.
+func findRoots(doc *html.Node) cssRoots {
+	var roots cssRoots
+
+	var walk func(*html.Node, int)
+	walk = func(n *html.Node, depth int) {
+		if depth > 2 || n.Type == html.ElementNode && n.Data != "html" && n.Data != "body" {
+			return
+		}
+
+		for _, a := range n.Attr {
+			switch strings.ToLower(a.Key) {
+			case "class":
+				roots.classes = append(roots.classes, strings.Fields(a.Val)...)
+			case "id":
+				roots.ids = append(roots.ids, a.Val)
+			}
+		}
+
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c, depth+1)
+		}
+	}
+
+	walk(doc, 0)
+
+	return roots
+}
+
+// unwrap replaces n with its children.
+func unwrap(n *html.Node) {
+	parent := n.Parent
+
+	for c := n.FirstChild; c != nil; {
+		next := c.NextSibling
+		n.RemoveChild(c)
+		parent.InsertBefore(c, n)
+		c = next
+	}
+
+	parent.RemoveChild(n)
+}
@@ -0,0 +1,161 @@
+package sanitize
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/html"
+)
+
+func TestHTMLSanitizeWithPolicy(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name    string
+		input   string
+		absent  []string
+		present []string
+	}{
+		{
+			"script",
+			`<p>a</p><script>alert(1)</script><SCRIPT SRC="x.js"></SCRIPT><p>b</p>`,
+			[]string{"script", "alert", "x.js"},
+			[]string{"<p>a</p><p>b</p>"},
+		},
+		{
+			"event handlers",
+			`<div onclick="alert(1)" ONMOUSEOVER="alert(2)" class="c"><img src="a.jpg" onerror="alert(3)"></div>`,
+			[]string{"onclick", "onmouseover", "onerror", "alert"},
+			[]string{`<div class="c"><img src="a.jpg"/></div>`},
+		},
+		{
+			"iframe",
+			`<iframe src="javascript:alert(1)"></iframe><iframe srcdoc="<script>alert(2)</script>"></iframe>`,
+			[]string{"iframe", "alert", "srcdoc"},
+			nil,
+		},
+		{
+			"object and embed",
+			`<object data="x.swf"><param name="a" value="b"><embed src="x.swf"></object><p>after</p>`,
+			[]string{"object", "param", "embed", "x.swf"},
+			[]string{"<p>after</p>"},
+		},
+		{
+			"meta refresh",
+			`<head><meta http-equiv="refresh" content="0;url=javascript:alert(1)"><meta charset="utf-8"></head>`,
+			[]string{"http-equiv", "refresh"},
+			[]string{`<meta charset="utf-8"/>`},
+		},
+		{
+			"base",
+			`<head><base href="https://evil.example/"></head><body><a href="a.html">a</a></body>`,
+			[]string{"base", "evil"},
+			[]string{`<a href="a.html">a</a>`},
+		},
+		{
+			"noscript parsed as text",
+			`<noscript><p title="</noscript><img src=x onerror=alert(1)>"></noscript>`,
+			[]string{"noscript", "onerror", "alert"},
+			nil,
+		},
+		{
+			"svg and math",
+			`<svg onload="alert(1)"><script>alert(2)</script></svg><math><mtext><img src=x onerror=alert(3)></math>`,
+			[]string{"svg", "math", "alert"},
+			nil,
+		},
+		{
+			"unknown elements keep their text",
+			`<font color="red">kept</font><marquee>also kept</marquee>`,
+			[]string{"font", "marquee", "color"},
+			[]string{"kept", "also kept"},
+		},
+		{
+			"comments",
+			`<p>a<!-- secret --></p>`,
+			[]string{"secret"},
+			[]string{"<p>a</p>"},
+		},
+		{
+			"allowed attributes",
+			`<a href="a.html" target="_blank" data-x="1" aria-label="l" style="color: red" formaction="b.html">a</a>`,
+			[]string{"formaction"},
+			[]string{`href="a.html"`, `target="_blank"`, `data-x="1"`, `aria-label="l"`, `style="color: red"`},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			doc, err := html.Parse(strings.NewReader(tt.input))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = HTMLSanitizeWithPolicy(doc, DefaultPolicy())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var buf bytes.Buffer
+
+			err = html.Render(&buf, doc)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			out := buf.String()
+
+			for _, v := range tt.absent {
+				if strings.Contains(strings.ToLower(out), v) {
+					t.Errorf("expected no %q in %q", v, out)
+				}
+			}
+
+			for _, v := range tt.present {
+				if !strings.Contains(out, v) {
+					t.Errorf("expected %q in %q", v, out)
+				}
+			}
+		})
+	}
+}
+
+func TestPolicyIsConfigurable(t *testing.T) {
+	t.Parallel()
+
+	policy := DefaultPolicy()
+	policy.Elements["video"] = []string{"src", "controls"}
+	delete(policy.Elements, "form")
+
+	doc, err := html.Parse(strings.NewReader(`<video src="a.html" controls autoplay></video><form><p>x</p></form>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = HTMLSanitizeWithPolicy(doc, policy)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+
+	err = html.Render(&buf, doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := `<html><head></head><body><video src="a.html" controls=""></video><p>x</p></body></html>`
+	if buf.String() != want {
+		t.Errorf("expected %q, got %q", want, buf.String())
+	}
+
+	_, form := DefaultPolicy().Elements["form"]
+	_, video := DefaultPolicy().Elements["video"]
+
+	if !form || video {
+		t.Error("changing a policy should not change the default")
+	}
+}
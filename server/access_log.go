@@ -0,0 +1,138 @@
+package server
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"time"
+)
+
+// Outcome is how a request for a page or image was satisfied.
+type Outcome string
+
+const (
+	// OutcomeHit served a file that already existed.
+	OutcomeHit Outcome = "hit"
+	// OutcomeGenerated started a new generation.
+	OutcomeGenerated Outcome = "generated"
+	// OutcomeJoined waited on a generation another request had already started.
+	OutcomeJoined Outcome = "joined"
+	// OutcomeRefused could not be served or generated, see Access.Error.
+	OutcomeRefused Outcome = "refused"
+)
+
+// Access is what the handlers learned about a request while serving it, for the access log.
+type Access struct {
+	Prefix  string
+	Slug    string
+	Outcome Outcome
+	Error   string
+}
+
+type accessKey struct{}
+
+// WithAccess returns a context under which AccessFrom returns a.
+func WithAccess(ctx context.Context, a *Access) context.Context {
+	return context.WithValue(ctx, accessKey{}, a)
+}
+
+// AccessFrom returns the Access of the request with ctx. Outside of AccessLog it returns an Access nobody reads, so
+// handlers can always fill it in.
+func AccessFrom(ctx context.Context) *Access {
+	a, ok := ctx.Value(accessKey{}).(*Access)
+	if !ok {
+		return &Access{"", "", "", ""}
+	}
+
+	return a
+}
+
+func (a *Access) refused(err error) {
+	a.Outcome = OutcomeRefused
+	a.Error = err.Error()
+}
+
+// AccessLog logs one record per request served by next, attributing requests from trusted proxies to the client
+// named in X-Forwarded-For.
+func AccessLog(logger *slog.Logger, trusted []netip.Prefix, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		// handlers may rewrite the path as they route
+		path := r.URL.Path
+
+		var a Access
+
+		cw := &countingWriter{w, 0, 0}
+		next.ServeHTTP(cw, r.WithContext(WithAccess(r.Context(), &a)))
+
+		if cw.status == 0 {
+			cw.status = http.StatusOK
+		}
+
+		attrs := []slog.Attr{
+			slog.String("method", r.Method),
+			slog.String("path", path),
+			slog.Int("status", cw.status),
+			slog.Int64("bytes", cw.bytes),
+			slog.Duration("duration", time.Since(start)),
+			slog.String("client", ClientIP(r, trusted)),
+		}
+
+		if a.Prefix != "" {
+			attrs = append(attrs, slog.String("prefix", a.Prefix))
+		}
+
+		if a.Slug != "" {
+			attrs = append(attrs, slog.String("slug", a.Slug))
+		}
+
+		if a.Outcome != "" {
+			attrs = append(attrs, slog.String("outcome", string(a.Outcome)))
+		}
+
+		if a.Error != "" {
+			attrs = append(attrs, slog.String("error", a.Error))
+		}
+
+		logger.LogAttrs(r.Context(), slog.LevelInfo, "request", attrs...)
+	})
+}
+
+// countingWriter records the status and size of a response. It passes flushes through so progress still streams.
+type countingWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *countingWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *countingWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+
+	return n, err //nolint:wrapcheck
+}
+
+func (w *countingWriter) Flush() {
+	flusher, ok := w.ResponseWriter.(http.Flusher)
+	if ok {
+		flusher.Flush()
+	}
+}
+
+func (w *countingWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,77 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAccessLog(t *testing.T) {
+	t.Parallel()
+
+	pool := NewWorkerPool(1, 1, nil, GroupLimits{0, 0})
+	t.Cleanup(func() { _ = pool.Close() })
+
+	discard := slog.New(slog.NewTextHandler(io.Discard, nil))
+	limiter := NewTokenBucketLimiter(0.001, 1, nil)
+	s := NewServer(echoSite{}, pool, "", discard, &DefaultProgressWriter{}, nil, nil, limiter, CancelPolicy{0, 0}, nil)
+
+	var b bytes.Buffer
+
+	handler := AccessLog(slog.New(slog.NewJSONHandler(&b, nil)), nil, http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			AccessFrom(r.Context()).Prefix = "site"
+			r.URL.Path = r.URL.Path[len("/site/"):]
+			s.Get().ServeHTTP(w, r)
+		}))
+
+	for _, path := range []string{"/site/a.jpg", "/site/b.jpg"} {
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		r.RemoteAddr = "192.0.2.1:1234"
+		handler.ServeHTTP(httptest.NewRecorder(), r)
+	}
+
+	tests := []struct {
+		slug    string
+		outcome Outcome
+		status  int
+		bytes   int
+	}{
+		{"a.jpg", OutcomeGenerated, http.StatusAccepted, len("a.jpg")},
+		{"b.jpg", OutcomeRefused, http.StatusTooManyRequests, -1},
+	}
+
+	decoder := json.NewDecoder(&b)
+
+	for _, tt := range tests {
+		var record struct {
+			Prefix  string  `json:"prefix"`
+			Slug    string  `json:"slug"`
+			Outcome Outcome `json:"outcome"`
+			Client  string  `json:"client"`
+			Status  int     `json:"status"`
+			Bytes   int     `json:"bytes"`
+		}
+
+		err := decoder.Decode(&record)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if record.Prefix != "site" || record.Slug != tt.slug || record.Client != "192.0.2.1" {
+			t.Errorf("%s: unexpected record %+v", tt.slug, record)
+		}
+
+		if record.Outcome != tt.outcome || record.Status != tt.status {
+			t.Errorf("%s: expected %s with status %d, got %+v", tt.slug, tt.outcome, tt.status, record)
+		}
+
+		if tt.bytes >= 0 && record.Bytes != tt.bytes {
+			t.Errorf("%s: expected %d bytes, got %d", tt.slug, tt.bytes, record.Bytes)
+		}
+	}
+}
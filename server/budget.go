@@ -0,0 +1,181 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/jasonthorsness/ginprov/generation"
+)
+
+var ErrBudgetExhausted = errors.New("generation budget exhausted")
+
+// BudgetJSON persists the usage of the current day so budgets survive restarts.
+const BudgetJSON = "budget.json"
+
+// Budget decides whether a site may start another generation.
+type Budget interface {
+	// Allow returns ErrBudgetExhausted once the budget is spent.
+	Allow() error
+	Spend(u generation.Usage) error
+}
+
+// Limits caps usage per day. Zero means no limit.
+type Limits struct {
+	Tokens int64
+	Images int64
+}
+
+func (l Limits) exhausted(u generation.Usage) bool {
+	return (l.Tokens > 0 && u.InputTokens+u.OutputTokens >= l.Tokens) || (l.Images > 0 && u.Images >= l.Images)
+}
+
+type budgetState struct {
+	Sites map[string]generation.Usage `json:"sites"`
+	Day   string                      `json:"day"`
+	Total generation.Usage            `json:"total"`
+}
+
+// DailyBudget tracks usage per UTC day, globally and per site, against fixed limits.
+type DailyBudget struct {
+	root      *os.Root
+	rootPath  string
+	overrides map[string]Limits
+	now       func() time.Time
+	state     budgetState
+	global    Limits
+	site      Limits
+	mu        sync.Mutex
+}
+
+// NewDailyBudget loads the current day's usage from BudgetJSON in root. Sites use siteLimits unless they have an
+// entry in overrides.
+func NewDailyBudget(
+	root *os.Root,
+	rootPath string,
+	global Limits,
+	siteLimits Limits,
+	overrides map[string]Limits,
+) (*DailyBudget, error) {
+	b := &DailyBudget{
+		root,
+		rootPath,
+		overrides,
+		time.Now,
+		budgetState{make(map[string]generation.Usage), "", generation.Usage{InputTokens: 0, OutputTokens: 0, Images: 0}},
+		global,
+		siteLimits,
+		sync.Mutex{},
+	}
+
+	f, err := root.Open(BudgetJSON)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return b, nil
+		}
+
+		return nil, fmt.Errorf("failed to open %s: %w", BudgetJSON, err)
+	}
+
+	defer func() {
+		_ = f.Close() // read only
+	}()
+
+	v, err := io.ReadAll(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", BudgetJSON, err)
+	}
+
+	err = json.Unmarshal(v, &b.state)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode %s: %w", BudgetJSON, err)
+	}
+
+	if b.state.Sites == nil {
+		b.state.Sites = make(map[string]generation.Usage)
+	}
+
+	return b, nil
+}
+
+// Site returns the Budget for a single site, which is also bound by the global limits.
+func (b *DailyBudget) Site(prefix string) Budget {
+	return &siteBudget{b, prefix}
+}
+
+func (b *DailyBudget) limitsFor(prefix string) Limits {
+	v, ok := b.overrides[prefix]
+	if ok {
+		return v
+	}
+
+	return b.site
+}
+
+// rollover resets the counters when the day changes. b.mu must be held.
+func (b *DailyBudget) rollover() {
+	day := b.now().UTC().Format(time.DateOnly)
+	if b.state.Day == day {
+		return
+	}
+
+	b.state.Day = day
+	b.state.Total = generation.Usage{InputTokens: 0, OutputTokens: 0, Images: 0}
+	b.state.Sites = make(map[string]generation.Usage)
+}
+
+func (b *DailyBudget) allow(prefix string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.rollover()
+
+	if b.global.exhausted(b.state.Total) {
+		return fmt.Errorf("%w: global daily limit reached", ErrBudgetExhausted)
+	}
+
+	if b.limitsFor(prefix).exhausted(b.state.Sites[prefix]) {
+		return fmt.Errorf("%w: daily limit for %s reached", ErrBudgetExhausted, prefix)
+	}
+
+	return nil
+}
+
+func (b *DailyBudget) spend(prefix string, u generation.Usage) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.rollover()
+
+	b.state.Total.Add(u)
+
+	site := b.state.Sites[prefix]
+	site.Add(u)
+	b.state.Sites[prefix] = site
+
+	v, err := json.Marshal(b.state)
+	if err != nil {
+		return fmt.Errorf("failed to encode %s: %w", BudgetJSON, err)
+	}
+
+	// spending is not part of any one generation
+	return writeFileAtomic(context.Background(), b.root, b.rootPath, BudgetJSON, v)
+}
+
+type siteBudget struct {
+	b      *DailyBudget
+	prefix string
+}
+
+func (s *siteBudget) Allow() error {
+	return s.b.allow(s.prefix)
+}
+
+func (s *siteBudget) Spend(u generation.Usage) error {
+	return s.b.spend(s.prefix, u)
+}
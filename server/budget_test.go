@@ -0,0 +1,71 @@
+package server
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/jasonthorsness/ginprov/generation"
+)
+
+func TestDailyBudget(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+
+	root, err := os.OpenRoot(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { _ = root.Close() })
+
+	global := Limits{Tokens: 100, Images: 0}
+	site := Limits{Tokens: 0, Images: 1}
+	overrides := map[string]Limits{"big": {Tokens: 0, Images: 0}}
+
+	b, err := NewDailyBudget(root, dir, global, site, overrides)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = b.Site("small").Spend(generation.Usage{InputTokens: 10, OutputTokens: 0, Images: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !errors.Is(b.Site("small").Allow(), ErrBudgetExhausted) {
+		t.Error("expected site image limit to be reached")
+	}
+
+	err = b.Site("big").Spend(generation.Usage{InputTokens: 0, OutputTokens: 0, Images: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if b.Site("big").Allow() != nil {
+		t.Error("expected override to lift the site image limit")
+	}
+
+	// a restart picks up where the day left off
+	b, err = NewDailyBudget(root, dir, global, site, overrides)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = b.Site("big").Spend(generation.Usage{InputTokens: 50, OutputTokens: 40, Images: 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !errors.Is(b.Site("other").Allow(), ErrBudgetExhausted) {
+		t.Error("expected global token limit to be reached")
+	}
+
+	b.now = func() time.Time { return time.Now().Add(24 * time.Hour) }
+
+	if b.Site("small").Allow() != nil {
+		t.Error("expected budget to reset on a new day")
+	}
+}
@@ -0,0 +1,140 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const ContentTypeEventStream = "text/event-stream"
+
+// EventProgressWriter reports progress as Server-Sent Events for custom front-ends and monitoring. Each event is
+// named for its kind (queued, started, chunk, retry, done or error) and carries a JSON object.
+type EventProgressWriter struct{}
+
+type queuedEvent struct {
+	Ahead          *int   `json:"ahead,omitempty"`
+	EstimatedStart string `json:"estimatedStart,omitempty"`
+}
+
+type chunkEvent struct {
+	Text string `json:"text"`
+}
+
+type retryEvent struct {
+	Reason      string `json:"reason"`
+	Message     string `json:"message"`
+	Attempt     int    `json:"attempt"`
+	MaxAttempts int    `json:"maxAttempts"`
+	DelayMS     int64  `json:"delayMs"`
+}
+
+type statusEvent struct {
+	Message string `json:"message,omitempty"`
+	Status  int    `json:"status"`
+}
+
+// wantsEvents reports whether r asked for progress as Server-Sent Events rather than an HTML page.
+func wantsEvents(r *http.Request) bool {
+	return r.URL.Query().Get("progress") == "events" ||
+		strings.Contains(r.Header.Get("Accept"), ContentTypeEventStream)
+}
+
+func (p *EventProgressWriter) Start(w http.ResponseWriter) {
+	writeEventHead(w, http.StatusOK)
+
+	flusher, ok := w.(http.Flusher)
+	if ok {
+		flusher.Flush()
+	}
+}
+
+func (p *EventProgressWriter) Progress(w http.ResponseWriter, v Progress) {
+	switch v.Kind {
+	case ProgressQueued:
+		e := queuedEvent{nil, ""}
+
+		if v.Queue != nil {
+			e.Ahead = &v.Queue.Ahead
+
+			if !v.Queue.Start.IsZero() {
+				e.EstimatedStart = v.Queue.Start.UTC().Format(time.RFC3339)
+			}
+		}
+
+		writeEvent(w, "queued", e)
+	case ProgressStarted:
+		writeEvent(w, "started", struct{}{})
+	case ProgressChunk:
+		writeEvent(w, "chunk", chunkEvent{v.Text})
+	case ProgressRetry:
+		writeEvent(w, "retry", retryEvent{
+			v.Retry.Reason,
+			v.Text,
+			v.Retry.Attempt,
+			v.Retry.MaxAttempts,
+			v.Retry.Delay.Milliseconds(),
+		})
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if ok {
+		flusher.Flush()
+	}
+}
+
+func (p *EventProgressWriter) Finish(w http.ResponseWriter, v HandleFunc) {
+	ww := &dummyResponseWriter{
+		headers: make(http.Header),
+		body:    []byte{},
+		code:    0,
+	}
+
+	err := v(ww)
+	if err != nil {
+		writeEvent(w, "error", statusEvent{err.Error(), statusForError(err)})
+		return
+	}
+
+	switch ww.code {
+	case 0, http.StatusOK, http.StatusAccepted:
+		writeEvent(w, "done", statusEvent{"", http.StatusOK})
+	default:
+		writeEvent(w, "error", statusEvent{strings.TrimSpace(string(ww.body)), ww.code})
+	}
+}
+
+func (p *EventProgressWriter) Reject(w http.ResponseWriter, code int, message string) {
+	writeEventHead(w, code)
+	writeEvent(w, "error", statusEvent{message, code})
+}
+
+func statusForError(err error) int {
+	switch {
+	case errors.Is(err, ErrUnsafe):
+		return http.StatusForbidden
+	case errors.Is(err, ErrBudgetExhausted):
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+func writeEventHead(w http.ResponseWriter, code int) {
+	w.Header().Set("Content-Type", ContentTypeEventStream)
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Accel-Buffering", "no") // keep nginx from holding events back
+	w.WriteHeader(code)
+}
+
+func writeEvent(w http.ResponseWriter, name string, data any) {
+	v, err := json.Marshal(data)
+	if err != nil {
+		return
+	}
+
+	_, _ = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", name, v)
+}
@@ -1,15 +1,26 @@
 package server
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"io/fs"
 	"os"
 	"path/filepath"
+	"strings"
+
+	"github.com/jasonthorsness/ginprov/tracing"
+	"go.opentelemetry.io/otel/attribute"
 )
 
-func writeFileAtomic(root *os.Root, rootPath string, slug string, v []byte) error {
+const extensionTemp = ".tmp"
+
+func writeFileAtomic(ctx context.Context, root *os.Root, rootPath string, slug string, v []byte) (err error) {
+	_, span := tracing.Start(ctx, "write", attribute.String("file", slug), attribute.Int("bytes", len(v)))
+	defer func() { tracing.End(span, err) }()
+
 	const writePermissions = 0o644
-	tmpSlug := slug + ".tmp"
+	tmpSlug := slug + extensionTemp
 
 	f, err := root.OpenFile(tmpSlug, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, writePermissions)
 	if err != nil {
@@ -59,3 +70,34 @@ func appendContents(root *os.Root, path string, contents []byte) (err error) {
 
 	return nil
 }
+
+// RemoveTempFiles deletes the temporary files left anywhere under root by writes that were interrupted, such as by
+// the process being killed. It must not be called while anything is writing to root. It returns the number of files
+// removed.
+func RemoveTempFiles(root *os.Root) (int, error) {
+	n := 0
+
+	err := fs.WalkDir(root.FS(), ".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if d.IsDir() || !strings.HasSuffix(path, extensionTemp) {
+			return nil
+		}
+
+		err = root.Remove(path)
+		if err != nil {
+			return fmt.Errorf("failed to remove %s: %w", path, err)
+		}
+
+		n++
+
+		return nil
+	})
+	if err != nil {
+		return n, fmt.Errorf("failed to remove temporary files: %w", err)
+	}
+
+	return n, nil
+}
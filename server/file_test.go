@@ -0,0 +1,51 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRemoveTempFiles(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+
+	for _, name := range []string{"index.html", "index.html.tmp", "a/b.jpg", "a/b.jpg.tmp"} {
+		path := filepath.Join(dir, name)
+
+		err := os.MkdirAll(filepath.Dir(path), 0o750)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = os.WriteFile(path, []byte("x"), 0o600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	root, err := os.OpenRoot(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer root.Close()
+
+	n, err := RemoveTempFiles(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n != 2 {
+		t.Errorf("expected 2 files removed, got %d", n)
+	}
+
+	for name, want := range map[string]bool{
+		"index.html": true, "index.html.tmp": false, "a/b.jpg": true, "a/b.jpg.tmp": false,
+	} {
+		_, err = os.Stat(filepath.Join(dir, name))
+		if got := err == nil; got != want {
+			t.Errorf("%s: expected exists %v, got %v", name, want, got)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestSiteSecurityHeaders(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+
+	root, err := os.OpenRoot(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { _ = root.Close() })
+
+	provider := &stubProvider{page: `<html><body><img src="photo.jpg"></body></html>`, text: "outline"}
+	headers := &SecurityHeaders{"default-src 'none'", "nosniff", "", "camera=()"}
+	prompter := NewPrompter(provider, "test-site", root, dir, nil)
+	site := NewSite(provider, prompter, root, dir, nil, headers, nil, nil, nil, nil)
+
+	for _, slug := range []string{IndexSlug, "photo.jpg"} {
+		_, generateFunc, err := site.Handle(slug)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		generated, err := generateFunc(context.Background(), func(string) {})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// the second is served from the file just written
+		cached, _, err := site.Handle(slug)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, handleFunc := range []HandleFunc{generated, cached} {
+			w := &dummyResponseWriter{headers: make(http.Header), body: []byte{}, code: 0}
+
+			err = handleFunc(w)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for k, want := range map[string]string{
+				"Content-Security-Policy": "default-src 'none'",
+				"X-Content-Type-Options":  "nosniff",
+				"Permissions-Policy":      "camera=()",
+			} {
+				if got := w.headers.Get(k); got != want {
+					t.Errorf("expected %s %q for %s, got %q", k, want, slug, got)
+				}
+			}
+
+			if _, ok := w.headers["Referrer-Policy"]; ok {
+				t.Errorf("expected no Referrer-Policy for %s", slug)
+			}
+		}
+	}
+}
+
+func TestDefaultSecurityHeadersAllowBanner(t *testing.T) {
+	t.Parallel()
+
+	w := &dummyResponseWriter{headers: make(http.Header), body: []byte{}, code: 0}
+	DefaultSecurityHeaders().set(w.Header())
+
+	csp := w.headers.Get("Content-Security-Policy")
+	for _, want := range []string{"script-src 'none'", "frame-src 'self'", "img-src 'self' data:"} {
+		if !strings.Contains(csp, want) {
+			t.Errorf("expected %q in %q", want, csp)
+		}
+	}
+}
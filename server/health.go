@@ -0,0 +1,115 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// Pinger is implemented by providers that can cheaply check they are reachable without generating anything.
+type Pinger interface {
+	Ping(ctx context.Context) error
+}
+
+// Readiness reports whether this process can take on new generations: the content directory is writable, the
+// worker pool has room, and the provider answers. Providers that are not a Pinger are assumed reachable. Pinging
+// is remembered for a while so frequent checks by a load balancer don't each reach the provider.
+type Readiness struct {
+	root       *os.Root
+	workerPool *WorkerPool
+	provider   Provider
+	interval   time.Duration
+	pinged     time.Time
+	pingErr    error
+	mu         sync.Mutex
+}
+
+func NewReadiness(root *os.Root, workerPool *WorkerPool, provider Provider, interval time.Duration) *Readiness {
+	return &Readiness{root, workerPool, provider, interval, time.Time{}, nil, sync.Mutex{}}
+}
+
+const readinessFile = ".readyz" + extensionTemp
+
+// Check returns why this process is not ready, or nil if it is.
+func (r *Readiness) Check(ctx context.Context) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	err := checkWritable(r.root)
+	if err != nil {
+		return fmt.Errorf("content directory is not writable: %w", err)
+	}
+
+	if r.workerPool.isClosed() {
+		return ErrShuttingDown
+	}
+
+	stats := r.workerPool.Stats()
+	if stats.Queued >= stats.Capacity {
+		return ErrWorkerPoolOverCapacity
+	}
+
+	pinger, ok := r.provider.(Pinger)
+	if !ok {
+		return nil
+	}
+
+	if r.pinged.IsZero() || time.Since(r.pinged) >= r.interval {
+		r.pingErr = pinger.Ping(ctx)
+		r.pinged = time.Now()
+	}
+
+	if r.pingErr != nil {
+		return fmt.Errorf("provider is unreachable: %w", r.pingErr)
+	}
+
+	return nil
+}
+
+func checkWritable(root *os.Root) error {
+	f, err := root.OpenFile(readinessFile, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, defaultFilePermissions)
+	if err != nil {
+		return fmt.Errorf("failed to open %s for write: %w", readinessFile, err)
+	}
+
+	_, err = f.Write([]byte("ok"))
+	err = errors.Join(err, f.Close(), root.Remove(readinessFile))
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %w", readinessFile, err)
+	}
+
+	return nil
+}
+
+// ServeHTTP answers 200 when ready and 503 with the reason when not.
+func (r *Readiness) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	const pingTimeout = 5 * time.Second
+
+	ctx, cancel := context.WithTimeout(req.Context(), pingTimeout)
+	defer cancel()
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+
+	err := r.Check(ctx)
+	if err != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = fmt.Fprintf(w, "not ready: %v\n", err)
+
+		return
+	}
+
+	_, _ = w.Write([]byte("ok\n"))
+}
+
+// Healthz answers 200 as long as the process can serve requests at all.
+func Healthz(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+
+	_, _ = w.Write([]byte("ok\n"))
+}
@@ -0,0 +1,88 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+// pingingProvider is a stubProvider that is reachable unless err is set.
+type pingingProvider struct {
+	stubProvider
+	err   error
+	pings int
+}
+
+func (p *pingingProvider) Ping(_ context.Context) error {
+	p.pings++
+	return p.err
+}
+
+func TestReadiness(t *testing.T) {
+	t.Parallel()
+
+	root, err := os.OpenRoot(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer root.Close()
+
+	pool := NewWorkerPool(1, 1, nil, GroupLimits{0, 0})
+	provider := &pingingProvider{stubProvider{"", ""}, nil, 0}
+	readiness := NewReadiness(root, pool, provider, time.Hour)
+
+	w := httptest.NewRecorder()
+	readiness.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+
+	if w.Code != http.StatusOK {
+		t.Errorf("expected ready, got %d %s", w.Code, w.Body.String())
+	}
+
+	// the provider failing is only noticed once the last ping is old enough
+	provider.err = errors.New("unreachable")
+
+	err = readiness.Check(context.Background())
+	if err != nil || provider.pings != 1 {
+		t.Errorf("expected the earlier ping to be reused, got %v after %d pings", err, provider.pings)
+	}
+
+	readiness.interval = 0
+
+	err = readiness.Check(context.Background())
+	if !errors.Is(err, provider.err) {
+		t.Errorf("expected the provider error, got %v", err)
+	}
+
+	provider.err = nil
+
+	// one job running and one waiting fill the pool
+	release := make(chan struct{})
+	block := func(context.Context, int) { <-release }
+
+	for range 2 {
+		DoWork(context.Background(), pool, 0, block, WorkOptions{nil, "", PriorityInteractiveHTML})
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	err = readiness.Check(context.Background())
+	if !errors.Is(err, ErrWorkerPoolOverCapacity) {
+		t.Errorf("expected ErrWorkerPoolOverCapacity, got %v", err)
+	}
+
+	close(release)
+	_ = pool.Close()
+
+	err = readiness.Check(context.Background())
+	if !errors.Is(err, ErrShuttingDown) {
+		t.Errorf("expected ErrShuttingDown, got %v", err)
+	}
+
+	entries, _ := os.ReadDir(root.Name())
+	if len(entries) != 0 {
+		t.Errorf("expected the content directory to be left empty, found %d entries", len(entries))
+	}
+}
@@ -0,0 +1,153 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/jasonthorsness/ginprov/metrics"
+)
+
+// Generation kinds for metrics.
+const (
+	KindHTML       = "html"
+	KindJPG        = "jpg"
+	KindOutline    = "outline"
+	KindSafety     = "safety"
+	KindModeration = "moderation"
+)
+
+// Metrics records what servers, sites and prompters do. A nil *Metrics records nothing.
+type Metrics struct {
+	generations *metrics.Counter
+	latency     *metrics.Histogram
+	errors      *metrics.Counter
+	joins       *metrics.Counter
+	lookups     *metrics.Counter
+	served      *metrics.Counter
+	unsafeSites *metrics.Counter
+	flags       *metrics.Counter
+}
+
+// NewMetrics registers the metrics in r, including the queue depth and busy workers of workerPool.
+func NewMetrics(r *metrics.Registry, workerPool *WorkerPool) *Metrics {
+	r.NewGaugeFunc("ginprov_queue_depth", "Work waiting for a worker.", func() float64 {
+		return float64(workerPool.Stats().Queued)
+	})
+
+	r.NewGaugeFunc("ginprov_workers_busy", "Workers doing work.", func() float64 {
+		return float64(workerPool.Stats().Busy)
+	})
+
+	return &Metrics{
+		r.NewCounter("ginprov_generations_total",
+			"Generations by kind (html, jpg, outline, safety or moderation) and outcome (success or error).",
+			"kind", "outcome"),
+		r.NewHistogram("ginprov_generation_duration_seconds",
+			"How long generations took by kind.", []float64{0.5, 1, 2.5, 5, 10, 20, 40, 80, 160}, "kind"),
+		r.NewCounter("ginprov_errors_total",
+			"Failed or refused generations by class.", "class"),
+		r.NewCounter("ginprov_singleflight_joins_total",
+			"Requests that joined a generation already pending for the same page."),
+		r.NewCounter("ginprov_cache_lookups_total",
+			"Requests for pages and images by result (hit for an existing file, miss if it must be generated).",
+			"result"),
+		r.NewCounter("ginprov_served_bytes_total",
+			"Bytes of pages and images served by kind.", "kind"),
+		r.NewCounter("ginprov_unsafe_sites_total",
+			"Sites refused by the safety assessment."),
+		r.NewCounter("ginprov_flagged_total",
+			"Pages and images refused by moderation by kind.", "kind"),
+	}
+}
+
+func (m *Metrics) generated(kind string, start time.Time, err error) {
+	if m == nil {
+		return
+	}
+
+	outcome := "success"
+	if err != nil {
+		outcome = "error"
+	}
+
+	m.generations.Inc(kind, outcome)
+	m.latency.Observe(time.Since(start).Seconds(), kind)
+}
+
+func (m *Metrics) failed(err error) {
+	if m == nil {
+		return
+	}
+
+	m.errors.Inc(errorClass(err))
+}
+
+func (m *Metrics) joined() {
+	if m == nil {
+		return
+	}
+
+	m.joins.Inc()
+}
+
+func (m *Metrics) lookup(hit bool) {
+	if m == nil {
+		return
+	}
+
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+
+	m.lookups.Inc(result)
+}
+
+func (m *Metrics) serve(slug string, n int64) {
+	if m == nil {
+		return
+	}
+
+	m.served.Add(float64(n), extensionForSlug(slug)[1:])
+}
+
+func (m *Metrics) unsafeSite() {
+	if m == nil {
+		return
+	}
+
+	m.unsafeSites.Inc()
+}
+
+func (m *Metrics) flagged(slug string) {
+	if m == nil {
+		return
+	}
+
+	m.flags.Inc(extensionForSlug(slug)[1:])
+}
+
+// errorClass groups errors into a few classes so the label stays small.
+func errorClass(err error) string {
+	switch {
+	case errors.Is(err, ErrFlagged):
+		return "flagged"
+	case errors.Is(err, ErrUnsafe):
+		return "unsafe"
+	case errors.Is(err, ErrBudgetExhausted):
+		return "budget"
+	case errors.Is(err, ErrRateLimited):
+		return "rate_limited"
+	case errors.Is(err, ErrWorkerPoolOverCapacity):
+		return "over_capacity"
+	case errors.Is(err, ErrShuttingDown):
+		return "shutting_down"
+	case errors.Is(err, ErrGeneratePanic):
+		return "panic"
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return "canceled"
+	default:
+		return "generation"
+	}
+}
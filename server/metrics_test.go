@@ -0,0 +1,139 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/jasonthorsness/ginprov/metrics"
+)
+
+func TestMetrics(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+
+	root, err := os.OpenRoot(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { _ = root.Close() })
+
+	pool := NewWorkerPool(1, 1, nil, GroupLimits{0, 0})
+	defer pool.Close()
+
+	registry := metrics.NewRegistry()
+	m := NewMetrics(registry, pool)
+
+	provider := &stubProvider{page: "<html><body>hello</body></html>", text: "outline"}
+	site := NewSite(provider, NewPrompter(provider, "test-site", root, dir, m), root, dir, nil, nil, nil, nil, nil, m)
+
+	_, generateFunc, err := site.Handle(IndexSlug)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handleFunc, err := generateFunc(context.Background(), func(string) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+
+	err = handleFunc(w)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// following a cached page as events sends no content
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	s := NewServer(site, pool, "", logger, &DefaultProgressWriter{}, nil, nil, nil, CancelPolicy{0, 0}, m)
+
+	events := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/"+IndexSlug+"?progress=events", nil)
+	r.URL.Path = IndexSlug
+	s.Get().ServeHTTP(events, r)
+
+	if !strings.Contains(events.Body.String(), "event: done\n") {
+		t.Errorf("expected the cached page to be done, got %q", events.Body.String())
+	}
+
+	m.failed(context.Canceled)
+
+	rec := httptest.NewRecorder()
+	registry.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	for _, want := range []string{
+		`ginprov_generations_total{kind="html",outcome="success"} 1`,
+		`ginprov_generations_total{kind="outline",outcome="success"} 1`,
+		`ginprov_generations_total{kind="safety",outcome="success"} 1`,
+		`ginprov_generation_duration_seconds_count{kind="html"} 1`,
+		`ginprov_errors_total{class="canceled"} 1`,
+		`ginprov_served_bytes_total{kind="html"} ` + strconv.Itoa(w.Body.Len()),
+		`ginprov_cache_lookups_total{result="hit"} 1`,
+		"ginprov_queue_depth 0",
+		"ginprov_workers_busy 0",
+	} {
+		if !strings.Contains(rec.Body.String(), want+"\n") {
+			t.Errorf("expected %q in\n%s", want, rec.Body.String())
+		}
+	}
+}
+
+type refusingSite struct {
+	err error
+}
+
+func (r refusingSite) Handle(_ string) (HandleFunc, GenerateFunc, error) {
+	return nil, nil, r.err
+}
+
+func TestMetricsRefused(t *testing.T) {
+	t.Parallel()
+
+	pool := NewWorkerPool(1, 1, nil, GroupLimits{0, 0})
+	t.Cleanup(func() { _ = pool.Close() })
+
+	registry := metrics.NewRegistry()
+	m := NewMetrics(registry, pool)
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	refused := func(w http.ResponseWriter) error {
+		w.WriteHeader(http.StatusForbidden)
+		return nil
+	}
+
+	for _, err := range []error{ErrUnsafe, fmt.Errorf("%w: %w", ErrFlagged, ErrUnsafe), ErrBudgetExhausted} {
+		s := NewServer(refusingSite{err}, pool, "", logger, &DefaultProgressWriter{}, refused, refused, nil,
+			CancelPolicy{0, 0}, m)
+
+		r := httptest.NewRequest(http.MethodGet, "/"+IndexSlug, nil)
+		r.URL.Path = IndexSlug
+		s.Get().ServeHTTP(httptest.NewRecorder(), r)
+	}
+
+	rec := httptest.NewRecorder()
+	registry.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	if strings.Contains(rec.Body.String(), "ginprov_cache_lookups_total{") {
+		t.Errorf("expected refused requests not to count as lookups in\n%s", rec.Body.String())
+	}
+
+	for _, want := range []string{
+		`ginprov_errors_total{class="unsafe"} 1`,
+		`ginprov_errors_total{class="flagged"} 1`,
+		`ginprov_errors_total{class="budget"} 1`,
+	} {
+		if !strings.Contains(rec.Body.String(), want+"\n") {
+			t.Errorf("expected %q in\n%s", want, rec.Body.String())
+		}
+	}
+}
@@ -0,0 +1,223 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"image"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/jasonthorsness/ginprov/generation"
+)
+
+func generateSlug(t *testing.T, site Site, slug string) error {
+	t.Helper()
+
+	_, generateFunc, err := site.Handle(slug)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handleFunc, err := generateFunc(context.Background(), func(string) {})
+
+	w := &dummyResponseWriter{headers: make(http.Header), body: []byte{}, code: 0}
+
+	handleErr := handleFunc(w)
+	if !errors.Is(handleErr, err) {
+		t.Errorf("expected the handler to report %v, got %v", err, handleErr)
+	}
+
+	return err
+}
+
+func TestSiteModerationFlagsPage(t *testing.T) {
+	t.Parallel()
+
+	provider := &stubProvider{
+		page: `<html><head><style>p { color: red }</style></head>` +
+			`<body><p>A <b>Forbidden</b> word</p><a href="other.html">x</a></body></html>`,
+		text: "outline",
+	}
+
+	site, root := newTestSite(t, provider, NewWordListModerator([]string{"forbidden"}))
+
+	err := generateSlug(t, site, IndexSlug)
+	if !errors.Is(err, ErrFlagged) || !errors.Is(err, ErrUnsafe) {
+		t.Fatalf("expected ErrFlagged wrapping ErrUnsafe, got %v", err)
+	}
+
+	_, err = root.Stat(IndexSlug)
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected flagged page not to be saved, got %v", err)
+	}
+
+	_, err = root.Stat(LinksTXT)
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected no links recorded from a flagged page, got %v", err)
+	}
+
+	// the page stays refused, but the site is not marked unsafe
+	_, _, err = site.Handle(IndexSlug)
+	if !errors.Is(err, ErrFlagged) {
+		t.Errorf("expected flagged page to stay refused, got %v", err)
+	}
+}
+
+func TestSiteHandleWhileModerating(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name    string
+		page    string
+		flagged bool
+	}{
+		{"flagged", "<html><body><p>forbidden</p></body></html>", true},
+		{"kept", "<html><body><p>fine</p></body></html>", false},
+	}
+
+	for _, tt := range tests {
+		site, _ := newTestSite(t, &stubProvider{tt.page, "outline"}, NewWordListModerator([]string{"forbidden"}))
+
+		_, generateFunc, err := site.Handle(IndexSlug)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		done := make(chan struct{})
+
+		go func() {
+			defer close(done)
+
+			_, _ = generateFunc(context.Background(), func(string) {})
+		}()
+
+		// other requests for the page don't wait for it, and race with it under -race if unsynchronized
+	loop:
+		for {
+			select {
+			case <-done:
+				break loop
+			default:
+				_, _, _ = site.Handle(IndexSlug)
+			}
+		}
+
+		_, generateFunc, err = site.Handle(IndexSlug)
+		if errors.Is(err, ErrFlagged) != tt.flagged || (err == nil && generateFunc != nil) {
+			t.Errorf("%s: expected flagged %v and nothing left to generate, got %v", tt.name, tt.flagged, err)
+		}
+	}
+}
+
+type visionStubProvider struct {
+	stubProvider
+	verdict string
+	images  int
+}
+
+func (p *visionStubProvider) Vision(_ context.Context, _ string, jpg []byte, _ generation.Options) (string, error) {
+	if len(jpg) == 0 {
+		return "", errors.New("no image")
+	}
+
+	p.images++
+
+	return p.verdict, nil
+}
+
+func TestSiteModerationFlagsImage(t *testing.T) {
+	t.Parallel()
+
+	page := `<html><body><img src="photo.jpg"></body></html>`
+	provider := &visionStubProvider{stubProvider{page, "outline"}, "graphic violence", 0}
+
+	site, root := newTestSite(t, provider, NewProviderModerator(provider))
+
+	err := generateSlug(t, site, IndexSlug)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = generateSlug(t, site, "photo.jpg")
+	if !errors.Is(err, ErrFlagged) || !strings.Contains(err.Error(), "graphic violence") {
+		t.Fatalf("expected ErrFlagged with the reason, got %v", err)
+	}
+
+	if provider.images != 1 {
+		t.Errorf("expected one image reviewed, got %d", provider.images)
+	}
+
+	_, err = root.Stat("photo.jpg")
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected flagged image not to be saved, got %v", err)
+	}
+
+	_, _, err = site.Handle(IndexSlug)
+	if err != nil {
+		t.Errorf("expected index.html to still be served, got %v", err)
+	}
+}
+
+func TestProviderModerator(t *testing.T) {
+	t.Parallel()
+
+	// stubProvider calls every safety check safe
+	err := NewProviderModerator(&stubProvider{"", ""}).ModerateText(context.Background(), "hello")
+	if err != nil {
+		t.Errorf("expected safe text, got %v", err)
+	}
+
+	m := NewProviderModerator(&unsafeProvider{stubProvider{"", ""}})
+
+	err = m.ModerateText(context.Background(), "hello")
+	if !errors.Is(err, ErrFlagged) {
+		t.Errorf("expected ErrFlagged, got %v", err)
+	}
+
+	// without image input there is nothing to ask
+	err = m.ModerateImage(context.Background(), image.NewRGBA(image.Rect(0, 0, 1, 1)))
+	if err != nil {
+		t.Errorf("expected images to pass without a VisionProvider, got %v", err)
+	}
+}
+
+func TestWordListModerator(t *testing.T) {
+	t.Parallel()
+
+	m := NewWordListModerator([]string{" Bad ", "", "worse"})
+
+	tests := []struct {
+		text    string
+		flagged bool
+	}{
+		{"all good here", false},
+		{"this is BAD.", true},
+		{"badge and badly", false},
+		{"worse-case", true},
+	}
+
+	for _, tt := range tests {
+		err := m.ModerateText(context.Background(), tt.text)
+		if errors.Is(err, ErrFlagged) != tt.flagged {
+			t.Errorf("ModerateText(%q) = %v, expected flagged %v", tt.text, err, tt.flagged)
+		}
+	}
+}
+
+func TestPageText(t *testing.T) {
+	t.Parallel()
+
+	text, err := pageText([]byte(`<html><head><title>Title</title><style>.x { y: z }</style></head>` +
+		`<body><p>Hello,
+		<i>world</i></p><img alt="a cat" src="cat.jpg"><a title="more" href="x.html">link</a></body></html>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "Title Hello, world a cat more link"
+	if text != expected {
+		t.Errorf("expected %q, got %q", expected, text)
+	}
+}
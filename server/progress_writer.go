@@ -5,19 +5,78 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"time"
+
+	"github.com/jasonthorsness/ginprov/generation"
+)
+
+type ProgressKind int
+
+const (
+	// ProgressQueued is sent to clients joining a generation that is waiting for a worker, and again whenever its
+	// place in line changes, with details in Queue.
+	ProgressQueued ProgressKind = iota
+	// ProgressStarted is sent when a worker picks up the generation, or to clients joining after that.
+	ProgressStarted
+	// ProgressChunk carries output streamed from the provider in Text.
+	ProgressChunk
+	// ProgressRetry is sent before a provider repeats a failed request, with a description in Text.
+	ProgressRetry
 )
 
+// Progress is a single update on a generation.
+type Progress struct {
+	Queue *QueuePosition
+	Text  string
+	Retry generation.Retry
+	Kind  ProgressKind
+}
+
+// QueuePosition is where a generation waits for a worker. Start is when it is expected to begin, or zero if the
+// pool cannot tell yet.
+type QueuePosition struct {
+	Start time.Time
+	Ahead int
+}
+
+func (q *QueuePosition) String() string {
+	v := fmt.Sprintf("Waiting for a free worker, position %d in line", q.Ahead+1)
+
+	if !q.Start.IsZero() {
+		v += fmt.Sprintf(", starting in about %s", max(time.Second, time.Until(q.Start).Round(time.Second)))
+	}
+
+	return v + "...\n"
+}
+
 type ProgressWriter interface {
 	Start(w http.ResponseWriter)
-	Chunk(w http.ResponseWriter, v string)
+	Progress(w http.ResponseWriter, v Progress)
 	Finish(w http.ResponseWriter, v HandleFunc)
+	// Reject renders a complete page with the given status when a generation is refused outright.
+	Reject(w http.ResponseWriter, code int, message string)
 }
 
 type DefaultProgressWriter struct{}
 
 func (p *DefaultProgressWriter) Start(w http.ResponseWriter) {
+	writeProgressHead(w, http.StatusAccepted)
+
+	flusher, ok := w.(http.Flusher)
+	if ok {
+		flusher.Flush()
+	}
+}
+
+func (p *DefaultProgressWriter) Reject(w http.ResponseWriter, code int, message string) {
+	writeProgressHead(w, code)
+	setTextContent(w, message, false)
+	_, _ = w.Write([]byte(`</body></html>`))
+}
+
+func writeProgressHead(w http.ResponseWriter, code int) {
 	w.Header().Set("Content-Type", ContentTypeHTML)
-	w.WriteHeader(http.StatusAccepted)
+	w.WriteHeader(code)
 	_, _ = w.Write([]byte(`<!DOCTYPE html>
 <html>
 <head>
@@ -49,15 +108,22 @@ func (p *DefaultProgressWriter) Start(w http.ResponseWriter) {
 <body>
   <div id="progress" style="white-space: pre;"></div>
 `))
-
-	flusher, ok := w.(http.Flusher)
-	if ok {
-		flusher.Flush()
-	}
 }
 
-func (p *DefaultProgressWriter) Chunk(w http.ResponseWriter, v string) {
-	setTextContent(w, v, true)
+func (p *DefaultProgressWriter) Progress(w http.ResponseWriter, v Progress) {
+	switch v.Kind {
+	case ProgressChunk:
+		setTextContent(w, v.Text, true)
+	case ProgressRetry:
+		setTextContent(w, "\n\n"+v.Text+"...\n\n", true)
+	case ProgressQueued:
+		// replaced by the next update, or cleared when generation starts
+		if v.Queue != nil {
+			setTextContent(w, v.Queue.String(), false)
+		}
+	case ProgressStarted:
+		setTextContent(w, "", false)
+	}
 
 	flusher, ok := w.(http.Flusher)
 	if ok {
@@ -97,7 +163,8 @@ func (p *DefaultProgressWriter) Finish(w http.ResponseWriter, v HandleFunc) {
 
 	err := v(ww)
 	if err != nil {
-		if errors.Is(err, ErrUnsafe) {
+		// reloading lets the server render its page for these
+		if errors.Is(err, ErrUnsafe) || errors.Is(err, ErrBudgetExhausted) {
 			setReload(w)
 			return
 		}
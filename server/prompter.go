@@ -8,23 +8,33 @@ import (
 	"os"
 	"strings"
 	"sync"
+	"time"
 
-	"github.com/jasonthorsness/ginprov/gemini"
+	"github.com/jasonthorsness/ginprov/generation"
+	"github.com/jasonthorsness/ginprov/tracing"
+	"go.opentelemetry.io/otel/attribute"
 )
 
+// Prompt is the input for generating a single slug. Options override the provider's defaults for this request only.
+type Prompt struct {
+	Text    string
+	Options generation.Options
+}
+
 type Prompter interface {
-	GetPromptForSlug(ctx context.Context, slug, links string, progress func(string)) (string, error)
+	GetPromptForSlug(ctx context.Context, slug, links string, progress func(string)) (Prompt, error)
 }
 
-func NewPrompter(gemini *gemini.Client, site string, root *os.Root, rootPath string) Prompter {
-	return &defaultPrompter{gemini, site, root, rootPath, "", sync.Mutex{}}
+func NewPrompter(provider Provider, site string, root *os.Root, rootPath string, metrics *Metrics) Prompter {
+	return &defaultPrompter{provider, site, root, rootPath, metrics, "", sync.Mutex{}}
 }
 
 type defaultPrompter struct {
-	gemini   *gemini.Client
+	provider Provider
 	site     string
 	root     *os.Root
 	rootPath string
+	metrics  *Metrics
 	outline  string
 	mu       sync.Mutex
 }
@@ -36,7 +46,7 @@ const unsafeOutline = "UNSAFE"
 const outlineTXT = "outline.txt"
 
 const safetyTemplate = `
-If the following topic is appropriate for all ages and audiences, respond with the single word "SAFE": {{slug}}.
+If the following topic is appropriate for all ages and audiences, ` + generation.SafetyRequest + `: {{slug}}.
 `
 
 const outlineTemplate = `
@@ -101,7 +111,7 @@ func (p *defaultPrompter) GetPromptForSlug(
 	slug string,
 	links string,
 	progress func(string),
-) (string, error) {
+) (Prompt, error) {
 	p.mu.Lock()
 	outline := p.outline
 	p.mu.Unlock()
@@ -109,7 +119,7 @@ func (p *defaultPrompter) GetPromptForSlug(
 	if outline == "" {
 		err := p.initOutline(ctx, progress)
 		if err != nil {
-			return "", err
+			return Prompt{}, err
 		}
 
 		p.mu.Lock()
@@ -118,21 +128,21 @@ func (p *defaultPrompter) GetPromptForSlug(
 	}
 
 	if outline == unsafeOutline {
-		return "", ErrUnsafe
+		return Prompt{}, ErrUnsafe
 	}
 
 	if strings.HasSuffix(slug, ".jpg") {
 		prompt := strings.ReplaceAll(imageTemplate, "{{slug}}", slug)
 		prompt = strings.ReplaceAll(prompt, "{{site}}", p.site)
 
-		return prompt, nil
+		return Prompt{prompt, generation.Options{}}, nil
 	}
 
 	prompt := strings.ReplaceAll(htmlTemplate, "{{slug}}", slug)
 	prompt = strings.ReplaceAll(prompt, "{{outline}}", outline)
 	prompt = strings.ReplaceAll(prompt, "{{links}}", links)
 
-	return prompt, nil
+	return Prompt{prompt, generation.Options{}}, nil
 }
 
 func (p *defaultPrompter) initOutline(ctx context.Context, progress func(string)) error {
@@ -154,7 +164,7 @@ func (p *defaultPrompter) initOutline(ctx context.Context, progress func(string)
 			return err
 		}
 
-		err = writeFileAtomic(p.root, p.rootPath, outlineTXT, []byte(p.outline))
+		err = writeFileAtomic(ctx, p.root, p.rootPath, outlineTXT, []byte(p.outline))
 		if err != nil {
 			return err
 		}
@@ -175,13 +185,21 @@ func (p *defaultPrompter) initOutline(ctx context.Context, progress func(string)
 func (p *defaultPrompter) genOutline(ctx context.Context, progress func(string)) error {
 	safetyPrompt := strings.ReplaceAll(safetyTemplate, "{{slug}}", p.site)
 
-	safe, err := p.gemini.Text(ctx, safetyPrompt, progress)
+	start := time.Now()
+	spanCtx, span := tracing.Start(ctx, "prompter.safety", attribute.String("site", p.site))
+
+	safe, err := p.provider.Text(spanCtx, safetyPrompt, generation.Options{}, progress)
+	p.metrics.generated(KindSafety, start, err)
+	tracing.End(span, err)
+
 	if err != nil {
-		return fmt.Errorf("failed to get safety assessment from gemini: %w", err)
+		return fmt.Errorf("failed to get safety assessment from provider: %w", err)
 	}
 
-	if safe != "SAFE" {
+	if safe != generation.Safe {
 		p.outline = unsafeOutline
+		p.metrics.unsafeSite()
+
 		return nil
 	}
 
@@ -189,9 +207,15 @@ func (p *defaultPrompter) genOutline(ctx context.Context, progress func(string))
 
 	outlinePrompt := strings.ReplaceAll(outlineTemplate, "{{slug}}", p.site)
 
-	outline, err := p.gemini.Text(ctx, outlinePrompt, progress)
+	start = time.Now()
+	spanCtx, span = tracing.Start(ctx, "prompter.outline", attribute.String("site", p.site))
+
+	outline, err := p.provider.Text(spanCtx, outlinePrompt, generation.Options{}, progress)
+	p.metrics.generated(KindOutline, start, err)
+	tracing.End(span, err)
+
 	if err != nil {
-		return fmt.Errorf("failed to get outline from gemini: %w", err)
+		return fmt.Errorf("failed to get outline from provider: %w", err)
 	}
 
 	p.outline = outline
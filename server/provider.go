@@ -0,0 +1,23 @@
+package server
+
+import (
+	"context"
+
+	"github.com/jasonthorsness/ginprov/generation"
+	"golang.org/x/net/html"
+)
+
+// Provider generates content from prompts. Options override the provider defaults for a single request.
+// Implementations stream intermediate output through progress, which may be nil. Sites do not retry failed
+// requests, so retrying transient failures is up to the implementation, as gemini.Client does with its RetryPolicy.
+type Provider interface {
+	HTML(ctx context.Context, prompt string, options generation.Options, progress func(string)) (*html.Node, error)
+	PNG(ctx context.Context, prompt string, options generation.Options, progress func(string)) ([]byte, error)
+	Text(ctx context.Context, prompt string, options generation.Options, progress func(string)) (string, error)
+}
+
+// VisionProvider is implemented by providers that can answer a prompt about a JPEG image. Moderation uses it to
+// review generated images.
+type VisionProvider interface {
+	Vision(ctx context.Context, prompt string, jpg []byte, options generation.Options) (string, error)
+}
@@ -0,0 +1,159 @@
+package server
+
+import (
+	"errors"
+	"math"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrRateLimited = errors.New("too many generation requests")
+
+// RateLimiter decides whether the client making a request may start another generation. When it may not, Allow
+// also returns how long the client should wait.
+type RateLimiter interface {
+	Allow(r *http.Request) (bool, time.Duration)
+}
+
+// TokenBucketLimiter is a RateLimiter with a token bucket per client IP. IPv6 clients are keyed by their /64 since
+// that is typically what a single subscriber is assigned.
+type TokenBucketLimiter struct {
+	buckets   map[string]*bucket
+	now       func() time.Time
+	lastSweep time.Time
+	trusted   []netip.Prefix
+	rate      float64
+	burst     float64
+	mu        sync.Mutex
+}
+
+type bucket struct {
+	last   time.Time
+	tokens float64
+}
+
+// NewTokenBucketLimiter allows each client burst generations at once, refilling at rate per second. Requests from
+// trusted proxies are attributed to the client named in X-Forwarded-For.
+func NewTokenBucketLimiter(rate float64, burst int, trusted []netip.Prefix) *TokenBucketLimiter {
+	return &TokenBucketLimiter{
+		make(map[string]*bucket),
+		time.Now,
+		time.Time{},
+		trusted,
+		rate,
+		float64(burst),
+		sync.Mutex{},
+	}
+}
+
+func (l *TokenBucketLimiter) Allow(r *http.Request) (bool, time.Duration) {
+	key := clientKey(ClientIP(r, l.trusted))
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	l.sweep(now)
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{now, l.burst}
+		l.buckets[key] = b
+	}
+
+	b.tokens = min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+
+	wait := time.Duration(math.Ceil((1-b.tokens)/l.rate)) * time.Second
+
+	return false, wait
+}
+
+// sweep drops buckets that have refilled completely, which are equivalent to no bucket. l.mu must be held.
+func (l *TokenBucketLimiter) sweep(now time.Time) {
+	const sweepInterval = time.Minute
+
+	if now.Sub(l.lastSweep) < sweepInterval {
+		return
+	}
+
+	l.lastSweep = now
+
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// ClientIP returns the address of the client making r. If the immediate peer is in trusted, X-Forwarded-For is
+// followed from the right past any other trusted proxies.
+func ClientIP(r *http.Request, trusted []netip.Prefix) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	client, err := netip.ParseAddr(host)
+	if err != nil {
+		return host
+	}
+
+	client = client.Unmap()
+
+	if !isTrusted(client, trusted) {
+		return client.String()
+	}
+
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			break
+		}
+
+		client = hop.Unmap()
+
+		if !isTrusted(client, trusted) {
+			break
+		}
+	}
+
+	return client.String()
+}
+
+func isTrusted(addr netip.Addr, trusted []netip.Prefix) bool {
+	for _, p := range trusted {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func clientKey(ip string) string {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil || addr.Is4() {
+		return ip
+	}
+
+	const subscriberBits = 64
+
+	p, err := addr.Prefix(subscriberBits)
+	if err != nil {
+		return ip
+	}
+
+	return p.String()
+}
@@ -0,0 +1,82 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestClientIP(t *testing.T) {
+	t.Parallel()
+
+	trusted := []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		forwarded  string
+		want       string
+	}{
+		{"direct", "192.0.2.1:1234", "", "192.0.2.1"},
+		{"untrusted peer ignores header", "192.0.2.1:1234", "198.51.100.7", "192.0.2.1"},
+		{"trusted peer", "10.0.0.1:1234", "198.51.100.7", "198.51.100.7"},
+		{"chain of proxies", "10.0.0.1:1234", "198.51.100.7, 203.0.113.9, 10.0.0.2", "203.0.113.9"},
+		{"only proxies", "10.0.0.1:1234", "10.0.0.3", "10.0.0.3"},
+		{"malformed hop", "10.0.0.1:1234", "junk", "10.0.0.1"},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = tt.remoteAddr
+
+		if tt.forwarded != "" {
+			r.Header.Set("X-Forwarded-For", tt.forwarded)
+		}
+
+		got := ClientIP(r, trusted)
+		if got != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestTokenBucketLimiter(t *testing.T) {
+	t.Parallel()
+
+	l := NewTokenBucketLimiter(1, 2, nil)
+
+	now := time.Now()
+	l.now = func() time.Time { return now }
+
+	a := httptest.NewRequest(http.MethodGet, "/", nil)
+	a.RemoteAddr = "192.0.2.1:1234"
+
+	b := httptest.NewRequest(http.MethodGet, "/", nil)
+	b.RemoteAddr = "192.0.2.2:1234"
+
+	for range 2 {
+		ok, _ := l.Allow(a)
+		if !ok {
+			t.Fatal("expected burst to be allowed")
+		}
+	}
+
+	ok, wait := l.Allow(a)
+	if ok || wait != time.Second {
+		t.Fatalf("expected refusal with a 1s wait, got %v %v", ok, wait)
+	}
+
+	ok, _ = l.Allow(b)
+	if !ok {
+		t.Fatal("expected other clients to be unaffected")
+	}
+
+	now = now.Add(time.Second)
+
+	ok, _ = l.Allow(a)
+	if !ok {
+		t.Fatal("expected bucket to refill")
+	}
+}
@@ -6,41 +6,144 @@ import (
 	"fmt"
 	"log/slog"
 	"net/http"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
+
+	"github.com/jasonthorsness/ginprov/generation"
+	"github.com/jasonthorsness/ginprov/tracing"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 var (
 	ErrWorkerPoolOverCapacity = errors.New("worker pool over capacity")
+	ErrShuttingDown           = errors.New("shutting down")
 	ErrGeneratePanic          = errors.New("generate function panicked")
 )
 
-type pending struct {
-	progressCh chan<- string
+type waiter struct {
+	progressCh chan<- Progress
 	resultCh   chan<- HandleFunc
 }
 
+// flight is a generation in progress along with the clients waiting on it.
+type flight struct {
+	waiters  []*waiter
+	cancel   context.CancelFunc
+	ticket   *Ticket
+	grace    *time.Timer
+	queue    *QueuePosition
+	progress int
+	started  bool
+	done     bool
+}
+
+// CancelPolicy decides what happens to a generation once every client waiting on it has gone.
+type CancelPolicy struct {
+	// Grace is how long to wait for a client to return before cancelling. Negative never cancels.
+	Grace time.Duration
+	// FinishAfter lets generations that have already streamed this many bytes of progress finish anyway. Zero
+	// disables this.
+	FinishAfter int
+}
+
 type Server struct {
-	pending       map[string][]pending
+	pending       map[string]*flight
+	lastErrors    map[string]string
 	workerPool    *WorkerPool
+	group         string
 	site          Site
 	logger        *slog.Logger
 	pw            ProgressWriter
 	unsafeHandler HandleFunc
+	budgetHandler HandleFunc
+	limiter       RateLimiter
+	cancelPolicy  CancelPolicy
+	metrics       *Metrics
 	mu            sync.Mutex
 }
 
+// NewServer creates a Server for site. Its generations share workerPool with other servers, counting toward group for
+// the pool's limits.
 func NewServer(
 	site Site,
 	workerPool *WorkerPool,
+	group string,
 	logger *slog.Logger,
 	pw ProgressWriter,
 	unsafeHandler HandleFunc,
+	budgetHandler HandleFunc,
+	limiter RateLimiter,
+	cancelPolicy CancelPolicy,
+	metrics *Metrics,
 ) *Server {
-	return &Server{make(map[string][]pending), workerPool, site, logger, pw, unsafeHandler, sync.Mutex{}}
+	return &Server{
+		make(map[string]*flight),
+		make(map[string]string),
+		workerPool,
+		group,
+		site,
+		logger,
+		pw,
+		unsafeHandler,
+		budgetHandler,
+		limiter,
+		cancelPolicy,
+		metrics,
+		sync.Mutex{},
+	}
+}
+
+// Status describes the state of a slug on a Server.
+type Status struct {
+	LastError string `json:"lastError,omitempty"`
+	Waiters   int    `json:"waiters"`
+	Bytes     int    `json:"bytes"`
+	Exists    bool   `json:"exists"`
+	Pending   bool   `json:"pending"`
+}
+
+// Status reports on slug without generating it. It returns ErrNotFound for slugs the site does not link to. Bytes
+// counts the progress streamed so far by a pending generation. LastError is from the most recent generation, or
+// why the slug cannot be generated right now.
+func (s *Server) Status(slug string) (Status, error) {
+	if slug == "" {
+		slug = IndexSlug
+	}
+
+	var v Status
+
+	_, generateFunc, err := s.site.Handle(slug)
+	if errors.Is(err, ErrNotFound) {
+		return v, err
+	}
+
+	v.Exists = err == nil && generateFunc == nil
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f, ok := s.pending[slug]
+	if ok {
+		v.Pending = true
+		v.Waiters = len(f.waiters)
+		v.Bytes = f.progress
+	}
+
+	v.LastError = s.lastErrors[slug]
+	if v.LastError == "" && err != nil {
+		v.LastError = err.Error()
+	}
+
+	return v, nil
 }
 
-//nolint:cyclop
+// Get serves slugs from the site, generating them as needed. Requests with ?progress=events or an Accept header
+// for text/event-stream follow generation as Server-Sent Events instead of receiving the content.
+//
+//nolint:cyclop,funlen
 func (s *Server) Get() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		ctx := r.Context()
@@ -50,55 +153,162 @@ func (s *Server) Get() http.HandlerFunc {
 			slug = IndexSlug
 		}
 
+		access := AccessFrom(ctx)
+		access.Slug = slug
+
+		events := wantsEvents(r)
+
+		pw := s.pw
+		if events {
+			pw = &EventProgressWriter{}
+		}
+
 		handleFunc, generateFunc, err := s.site.Handle(slug)
+		if errors.Is(err, ErrNotFound) {
+			handleFunc, generateFunc, err = s.site.Handle(NotFoundSlug)
+		}
+
 		if err != nil {
+			s.metrics.failed(err)
+			access.refused(err)
+
 			switch {
+			case events:
+				pw.Start(w)
+				pw.Finish(w, func(_ http.ResponseWriter) error { return err })
+
+				return
 			case errors.Is(err, ErrUnsafe):
 				handleFunc = s.unsafeHandler
-			case errors.Is(err, ErrNotFound):
-				handleFunc, generateFunc, err = s.site.Handle(NotFoundSlug)
-				if err != nil {
-					http.Error(w, err.Error(), http.StatusInternalServerError)
-					return
-				}
+			case errors.Is(err, ErrBudgetExhausted):
+				handleFunc = s.budgetHandler
 			default:
 				http.Error(w, err.Error(), http.StatusInternalServerError)
 				return
 			}
 		}
 
+		if err == nil {
+			s.metrics.lookup(generateFunc == nil)
+		}
+
+		if generateFunc == nil && err == nil {
+			access.Outcome = OutcomeHit
+		}
+
+		if generateFunc == nil && events {
+			pw.Start(w)
+			pw.Finish(w, handleFunc)
+
+			return
+		}
+
 		if generateFunc == nil {
 			err = handleFunc(w)
 			if err != nil {
+				access.Error = err.Error()
 				s.logger.Error("failed to serve file", "slug", slug, "error", err)
+
 				return
 			}
 
 			return
 		}
 
-		progressCh, resultCh, err := s.singleFlightGenerate(slug, generateFunc) //nolint:contextcheck
+		supportsProgress := events || strings.HasSuffix(slug, ExtensionHTML)
+
+		var retryAfter time.Duration
+
+		admit := func() bool {
+			if s.limiter == nil {
+				return true
+			}
+
+			ok, wait := s.limiter.Allow(r)
+			retryAfter = wait
+
+			return ok
+		}
+
+		priority := priorityFor(r, slug)
+
+		progressCh, resultCh, leave, err := s.singleFlightGenerate(
+			ctx,
+			slug,
+			generateFunc,
+			admit,
+			priority)
 		if err != nil {
+			s.metrics.failed(err)
+			access.refused(err)
+
+			switch {
+			case errors.Is(err, ErrRateLimited):
+				seconds := max(1, int(retryAfter.Seconds()))
+				message := fmt.Sprintf("429\n\nToo many new pages requested. Try again in %d seconds.", seconds)
+				reject(w, http.StatusTooManyRequests, seconds, message, supportsProgress, pw)
+
+				return
+			case errors.Is(err, ErrShuttingDown):
+				const seconds = 30
+				message := "503\n\nThe server is restarting. Try again in a moment."
+				reject(w, http.StatusServiceUnavailable, seconds, message, supportsProgress, pw)
+
+				return
+			}
+
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 
 			return
 		}
 
-		supportsProgress := strings.HasSuffix(slug, ExtensionHTML)
+		defer leave()
 
-		if supportsProgress {
-			err = handleWithProgress(ctx, w, progressCh, resultCh, s.pw)
-		} else {
+		switch {
+		case events:
+			pw.Start(w)
+			followProgress(ctx, w, progressCh, resultCh, pw)
+		case supportsProgress:
+			err = handleWithProgress(ctx, w, progressCh, resultCh, pw)
+		default:
 			err = handleWithoutProgress(ctx, w, handleFunc, resultCh)
 		}
 
 		if err != nil {
+			access.Error = err.Error()
 			s.logger.Error("failed to serve file", "slug", slug, "error", err)
+
 			return
 		}
 	}
 }
 
+// priorityFor treats speculative loads by the browser as background work.
+func priorityFor(r *http.Request, slug string) Priority {
+	if strings.Contains(r.Header.Get("Sec-Purpose"), "prefetch") || r.Header.Get("Purpose") == "prefetch" {
+		return PriorityBackground
+	}
+
+	if strings.HasSuffix(slug, ExtensionHTML) {
+		return PriorityInteractiveHTML
+	}
+
+	return PriorityInteractiveImage
+}
+
+// reject refuses to start a generation that may succeed if retried after the given number of seconds.
+func reject(w http.ResponseWriter, code int, seconds int, message string, supportsProgress bool, pw ProgressWriter) {
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	w.Header().Set("Cache-Control", "no-store")
+
+	if supportsProgress {
+		pw.Reject(w, code, message)
+		return
+	}
+
+	http.Error(w, message, code)
+}
+
 func handleWithoutProgress(
 	ctx context.Context,
 	w http.ResponseWriter,
@@ -121,90 +331,217 @@ func handleWithoutProgress(
 func handleWithProgress(
 	ctx context.Context,
 	w http.ResponseWriter,
-	progressCh <-chan string,
+	progressCh <-chan Progress,
 	resultCh <-chan HandleFunc,
 	pw ProgressWriter,
 ) error {
+	select {
+	case <-ctx.Done():
+		return nil
+	case v := <-progressCh:
+		pw.Start(w)
+		pw.Progress(w, v)
+		followProgress(ctx, w, progressCh, resultCh, pw)
+
+		return nil
+	case handleFunc := <-resultCh:
+		return handleFunc(w)
+	}
+}
+
+// followProgress writes progress until the result arrives or the client goes away. pw.Start must have been called.
+func followProgress(
+	ctx context.Context,
+	w http.ResponseWriter,
+	progressCh <-chan Progress,
+	resultCh <-chan HandleFunc,
+	pw ProgressWriter,
+) {
 	for {
 		select {
 		case <-ctx.Done():
-			return nil
+			return
 		case v := <-progressCh:
-			pw.Start(w)
-			pw.Chunk(w, v)
-
+			pw.Progress(w, v)
+		case v := <-resultCh:
+			// progress is always sent before the result, but select may have picked the result first
 			for {
 				select {
-				case <-ctx.Done():
-					return nil
-				case v = <-progressCh:
-					pw.Chunk(w, v)
-				case vv := <-resultCh:
-					pw.Finish(w, vv)
-					return nil
+				case p := <-progressCh:
+					pw.Progress(w, p)
+				default:
+					pw.Finish(w, v)
+					return
 				}
 			}
-		case handleFunc := <-resultCh:
-			return handleFunc(w)
 		}
 	}
 }
 
+// singleFlightGenerate joins the pending generation of slug or, if admit allows it, starts a new one. Joining is
+// never refused since it costs nothing extra, and raises a waiting generation to priority if that is higher. The
+// caller must call leave once it stops waiting for the result. A new generation is traced as part of parent but
+// outlives it.
 func (s *Server) singleFlightGenerate(
+	parent context.Context,
 	slug string,
 	generateFunc GenerateFunc,
-) (<-chan string, <-chan HandleFunc, error) {
+	admit func() bool,
+	priority Priority,
+) (<-chan Progress, <-chan HandleFunc, func(), error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	f, ok := s.pending[slug]
+	if !ok {
+		if !admit() {
+			return nil, nil, nil, ErrRateLimited
+		}
+
+		ctx, cancel := context.WithCancel(context.WithoutCancel(parent))
+		f = &flight{nil, cancel, nil, nil, nil, 0, false, false}
+
+		// the work cannot start before s.mu is released so adding f to pending afterward is fine
+		queued := func(ahead int, start time.Time) { s.queued(f, ahead, start) }
+		options := WorkOptions{queued, s.group, priority}
+
+		f.ticket = DoWork(ctx, s.workerPool, generateFunc, s.generate(slug, f), options)
+		if f.ticket == nil {
+			cancel()
+
+			if s.workerPool.isClosed() {
+				return nil, nil, nil, ErrShuttingDown
+			}
+
+			return nil, nil, nil, ErrWorkerPoolOverCapacity
+		}
+
+		s.pending[slug] = f
+		AccessFrom(parent).Outcome = OutcomeGenerated
+	} else {
+		f.ticket.Raise(priority)
+		s.metrics.joined()
+		AccessFrom(parent).Outcome = OutcomeJoined
+	}
+
+	if f.grace != nil {
+		f.grace.Stop()
+		f.grace = nil
+	}
+
 	const progressChannelLength = 4
 
-	progressCh := make(chan string, progressChannelLength)
+	progressCh := make(chan Progress, progressChannelLength)
 	resultCh := make(chan HandleFunc, 1)
 
-	p, ok := s.pending[slug]
-	s.pending[slug] = append(p, pending{progressCh, resultCh})
+	if f.started {
+		progressCh <- Progress{nil, "", generation.Retry{}, ProgressStarted}
+	} else {
+		progressCh <- Progress{f.queue, queueText(f.queue), generation.Retry{}, ProgressQueued}
+	}
 
-	ctx := context.Background()
+	w := &waiter{progressCh, resultCh}
+	f.waiters = append(f.waiters, w)
 
-	if !ok {
-		if !DoWork(ctx, s.workerPool, generateFunc, s.generate(slug)) {
+	return progressCh, resultCh, func() { s.leave(slug, f, w) }, nil
+}
+
+// queued tells the clients waiting on f where it stands in the worker pool queue.
+func (s *Server) queued(f *flight, ahead int, start time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if f.started || f.done {
+		return
+	}
+
+	f.queue = &QueuePosition{start, ahead}
+
+	for _, w := range f.waiters {
+		trySend(w.progressCh, Progress{f.queue, f.queue.String(), generation.Retry{}, ProgressQueued})
+	}
+}
+
+func queueText(q *QueuePosition) string {
+	if q == nil {
+		return ""
+	}
+
+	return q.String()
+}
+
+// leave removes w from f and, if it was the last waiter, schedules f to be cancelled per s.cancelPolicy.
+func (s *Server) leave(slug string, f *flight, w *waiter) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f.waiters = slices.DeleteFunc(f.waiters, func(v *waiter) bool { return v == w })
+
+	if len(f.waiters) > 0 || f.done || s.cancelPolicy.Grace < 0 {
+		return
+	}
+
+	f.grace = time.AfterFunc(s.cancelPolicy.Grace, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		if len(f.waiters) > 0 || f.done {
+			return
+		}
+
+		if s.cancelPolicy.FinishAfter > 0 && f.progress >= s.cancelPolicy.FinishAfter {
+			return
+		}
+
+		// later requests start over rather than join a generation that is winding down
+		if s.pending[slug] == f {
 			delete(s.pending, slug)
-			return nil, nil, ErrWorkerPoolOverCapacity
 		}
-	}
 
-	return progressCh, resultCh, nil
+		s.logger.Info("cancelling abandoned generation", "slug", slug, "progress", f.progress)
+		f.cancel()
+	})
 }
 
-func (s *Server) generate(slug string) func(context.Context, GenerateFunc) {
+func (s *Server) generate(slug string, f *flight) func(context.Context, GenerateFunc) {
 	return func(ctx context.Context, generateFunc GenerateFunc) {
 		var v HandleFunc
+		var err error
 
-		defer func() {
-			var err error
+		ctx, span := tracing.Start(ctx, "generate", attribute.String("slug", slug))
 
+		defer func() {
 			r := recover()
 			if r != nil {
 				err = fmt.Errorf("%w: %v ", ErrGeneratePanic, r)
+				v = func(w http.ResponseWriter) error {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return nil
+				}
 			}
 
-			p := func() []pending {
+			p := func() []*waiter {
 				s.mu.Lock()
 				defer s.mu.Unlock()
 
-				p := s.pending[slug]
-				delete(s.pending, slug)
+				if s.pending[slug] == f {
+					delete(s.pending, slug)
+				}
 
-				return p
+				if err != nil {
+					s.lastErrors[slug] = err.Error()
+					s.metrics.failed(err)
+				} else {
+					delete(s.lastErrors, slug)
+				}
+
+				f.done = true
+				f.cancel()
+
+				return slices.Clone(f.waiters)
 			}()
 
-			if err != nil {
-				v = func(w http.ResponseWriter) error {
-					http.Error(w, err.Error(), http.StatusInternalServerError)
-					return nil
-				}
-			}
+			tracing.End(span, err)
 
 			for _, pp := range p {
 				if !trySend(pp.resultCh, v) {
@@ -213,14 +550,31 @@ func (s *Server) generate(slug string) func(context.Context, GenerateFunc) {
 			}
 		}()
 
-		v = generateFunc(ctx, func(progress string) {
+		send := func(v Progress) {
 			s.mu.Lock()
 			defer s.mu.Unlock()
 
-			p := s.pending[slug]
-			for _, pp := range p {
-				trySend(pp.progressCh, progress)
+			if v.Kind == ProgressStarted {
+				f.started = true
+			}
+
+			if v.Kind == ProgressChunk {
+				f.progress += len(v.Text)
+			}
+
+			for _, pp := range f.waiters {
+				trySend(pp.progressCh, v)
 			}
+		}
+
+		send(Progress{nil, "", generation.Retry{}, ProgressStarted})
+
+		ctx = generation.WithRetry(ctx, func(r generation.Retry) {
+			send(Progress{nil, r.String(), r, ProgressRetry})
+		})
+
+		v, err = generateFunc(ctx, func(progress string) {
+			send(Progress{nil, progress, generation.Retry{}, ProgressChunk})
 		})
 	}
 }
@@ -0,0 +1,255 @@
+package server
+
+import (
+	"context"
+	"image/jpeg"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jasonthorsness/ginprov/fake"
+	"github.com/jasonthorsness/ginprov/generation"
+)
+
+// blockingSite generates until its context is cancelled, reporting progress of size bytes first.
+type blockingSite struct {
+	cancelled chan struct{}
+	size      int
+}
+
+func (b *blockingSite) Handle(_ string) (HandleFunc, GenerateFunc, error) {
+	handleFunc := func(w http.ResponseWriter) error {
+		w.WriteHeader(http.StatusAccepted)
+		return nil
+	}
+
+	generateFunc := func(ctx context.Context, progress func(string)) (HandleFunc, error) {
+		progress(string(make([]byte, b.size)))
+
+		select {
+		case <-ctx.Done():
+			close(b.cancelled)
+			return handleFunc, ctx.Err()
+		case <-time.After(time.Second):
+			return handleFunc, nil
+		}
+	}
+
+	return handleFunc, generateFunc, nil
+}
+
+// echoSite generates every slug by streaming it back as progress.
+type echoSite struct{}
+
+func (echoSite) Handle(slug string) (HandleFunc, GenerateFunc, error) {
+	handleFunc := func(w http.ResponseWriter) error {
+		w.WriteHeader(http.StatusAccepted)
+		return nil
+	}
+
+	generateFunc := func(_ context.Context, progress func(string)) (HandleFunc, error) {
+		progress(slug)
+
+		return func(w http.ResponseWriter) error {
+			_, err := w.Write([]byte(slug))
+			return err
+		}, nil
+	}
+
+	return handleFunc, generateFunc, nil
+}
+
+func TestServerEvents(t *testing.T) {
+	t.Parallel()
+
+	pool := NewWorkerPool(1, 1, nil, GroupLimits{0, 0})
+	t.Cleanup(func() { _ = pool.Close() })
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	s := NewServer(echoSite{}, pool, "", logger, &DefaultProgressWriter{}, nil, nil, nil, CancelPolicy{0, 0}, nil)
+
+	r := httptest.NewRequest(http.MethodGet, "/a.jpg?progress=events", nil)
+	r.URL.Path = "a.jpg"
+	w := httptest.NewRecorder()
+
+	s.Get().ServeHTTP(w, r)
+
+	if w.Header().Get("Content-Type") != ContentTypeEventStream {
+		t.Fatalf("expected an event stream, got %q", w.Header().Get("Content-Type"))
+	}
+
+	want := []string{
+		"event: queued\n",
+		"event: started\n",
+		"event: chunk\ndata: {\"text\":\"a.jpg\"}\n",
+		"event: done\ndata: {\"status\":200}\n",
+	}
+
+	body := w.Body.String()
+
+	for _, v := range want {
+		i := strings.Index(body, v)
+		if i < 0 {
+			t.Fatalf("expected %q in order in %q", v, w.Body.String())
+		}
+
+		body = body[i+len(v):]
+	}
+}
+
+func TestServerCancelsAbandonedGeneration(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name   string
+		size   int
+		cancel bool
+	}{
+		{"abandoned", 10, true},
+		{"well underway", 100, false},
+	}
+
+	for _, tt := range tests {
+		site := &blockingSite{make(chan struct{}), tt.size}
+		pool := NewWorkerPool(1, 1, nil, GroupLimits{0, 0})
+		logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+		policy := CancelPolicy{Grace: 10 * time.Millisecond, FinishAfter: 50}
+		s := NewServer(site, pool, "", logger, &DefaultProgressWriter{}, nil, nil, nil, policy, nil)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		r := httptest.NewRequestWithContext(ctx, http.MethodGet, "/a.jpg", nil)
+
+		done := make(chan struct{})
+
+		go func() {
+			s.Get().ServeHTTP(httptest.NewRecorder(), r)
+			close(done)
+		}()
+
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+		<-done
+
+		select {
+		case <-site.cancelled:
+			if !tt.cancel {
+				t.Errorf("%s: expected generation to finish", tt.name)
+			}
+		case <-time.After(200 * time.Millisecond):
+			if tt.cancel {
+				t.Errorf("%s: expected generation to be cancelled", tt.name)
+			}
+		}
+
+		_ = pool.Close()
+	}
+}
+
+func TestServerStatus(t *testing.T) {
+	t.Parallel()
+
+	site := &blockingSite{make(chan struct{}), 10}
+	pool := NewWorkerPool(1, 1, nil, GroupLimits{0, 0})
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	s := NewServer(site, pool, "", logger, &DefaultProgressWriter{}, nil, nil, nil, CancelPolicy{0, 0}, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r := httptest.NewRequestWithContext(ctx, http.MethodGet, "/a.jpg", nil)
+	r.URL.Path = "a.jpg"
+
+	done := make(chan struct{})
+
+	go func() {
+		s.Get().ServeHTTP(httptest.NewRecorder(), r)
+		close(done)
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+
+	v, err := s.Status("a.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !v.Pending || v.Waiters != 1 || v.Bytes != 10 || v.Exists {
+		t.Errorf("unexpected status while generating: %+v", v)
+	}
+
+	cancel()
+	<-done
+	_ = pool.Close()
+
+	v, err = s.Status("a.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v.Pending || v.LastError != context.Canceled.Error() {
+		t.Errorf("unexpected status after cancelling: %+v", v)
+	}
+}
+
+// TestServerFakeRoundTrip generates an index, a page it links to and an image that page shows with fake.Client,
+// the way a visitor following links would.
+func TestServerFakeRoundTrip(t *testing.T) {
+	t.Parallel()
+
+	provider := fake.New(0, generation.Defaults{})
+	site, _ := newTestSite(t, provider, nil)
+
+	pool := NewWorkerPool(1, 1, nil, GroupLimits{0, 0})
+	t.Cleanup(func() { _ = pool.Close() })
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	s := NewServer(site, pool, "", logger, &DefaultProgressWriter{}, nil, nil, nil, CancelPolicy{0, 0}, nil)
+
+	get := func(slug string) string {
+		t.Helper()
+
+		r := httptest.NewRequest(http.MethodGet, "/"+slug+"?progress=events", nil)
+		r.URL.Path = slug
+		w := httptest.NewRecorder()
+
+		s.Get().ServeHTTP(w, r)
+
+		if !strings.Contains(w.Body.String(), "event: done\ndata: {\"status\":200}\n") {
+			t.Fatalf("expected %s to be generated, got %q", slug, w.Body.String())
+		}
+
+		r = httptest.NewRequest(http.MethodGet, "/"+slug, nil)
+		r.URL.Path = slug
+		w = httptest.NewRecorder()
+
+		s.Get().ServeHTTP(w, r)
+
+		if w.Code != http.StatusOK || w.Header().Get("Content-Type") != contentTypeForSlug(slug) {
+			t.Fatalf("expected %s to be served, got %d %q", slug, w.Code, w.Header().Get("Content-Type"))
+		}
+
+		return w.Body.String()
+	}
+
+	index := get(IndexSlug)
+
+	link := regexp.MustCompile(`href="([a-z0-9-]+\.html)"`).FindStringSubmatch(index)
+	if link == nil {
+		t.Fatalf("expected a link in %q", index)
+	}
+
+	page := get(link[1])
+
+	src := regexp.MustCompile(`src="([a-z0-9-]+\.jpg)"`).FindStringSubmatch(page)
+	if src == nil {
+		t.Fatalf("expected an image in %q", page)
+	}
+
+	_, err := jpeg.Decode(strings.NewReader(get(src[1])))
+	if err != nil {
+		t.Errorf("expected a JPEG for %s: %v", src[1], err)
+	}
+}
@@ -5,9 +5,11 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"image"
 	"image/jpeg"
 	"image/png"
 	"io"
+	"log/slog"
 	"net/http"
 	"net/url"
 	"os"
@@ -15,15 +17,20 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
-	"github.com/jasonthorsness/ginprov/gemini"
+	"github.com/jasonthorsness/ginprov/generation"
 	"github.com/jasonthorsness/ginprov/sanitize"
+	"github.com/jasonthorsness/ginprov/tracing"
 	"golang.org/x/net/html"
 )
 
 type (
-	HandleFunc      func(http.ResponseWriter) error
-	GenerateFunc    func(context.Context, func(string)) HandleFunc
+	HandleFunc func(http.ResponseWriter) error
+	// GenerateFunc generates a slug and returns how to serve the outcome. A failure is rendered by the HandleFunc
+	// and also returned so it can be recorded.
+	GenerateFunc    func(context.Context, func(string)) (HandleFunc, error)
 	HTMLTransformer func(*html.Node, map[string]struct{}) error
 )
 
@@ -56,35 +63,84 @@ type Site interface {
 	Handle(slug string) (HandleFunc, GenerateFunc, error)
 }
 
+// NewSite returns a Site generating into root. Generated pages are stripped of anything policy does not allow, or
+// sanitize.DefaultPolicy if it is nil, before transformer runs. Generated pages and images are served with headers,
+// or DefaultSecurityHeaders if it is nil. Moderator may be nil to keep everything generated, budget nil for unlimited
+// generation, and metrics nil to record nothing.
 func NewSite(
-	gemini *gemini.Client,
+	provider Provider,
 	prompter Prompter,
 	root *os.Root,
 	rootPath string,
+	policy *sanitize.Policy,
+	headers *SecurityHeaders,
+	moderator Moderator,
 	transformer HTMLTransformer,
+	budget Budget,
+	metrics *Metrics,
 ) Site {
-	return &defaultSite{gemini, nil, prompter, root, rootPath, transformer, "", sync.Mutex{}, false}
+	if policy == nil {
+		policy = sanitize.DefaultPolicy()
+	}
+
+	if headers == nil {
+		headers = DefaultSecurityHeaders()
+	}
+
+	return &defaultSite{
+		provider,
+		nil,
+		prompter,
+		root,
+		rootPath,
+		policy,
+		headers,
+		moderator,
+		transformer,
+		budget,
+		metrics,
+		"",
+		generation.Usage{InputTokens: 0, OutputTokens: 0, Images: 0},
+		sync.Mutex{},
+		atomic.Bool{},
+	}
 }
 
+// resource is a page or image of the site. Mu is held while it is generated; size and flagged are only set under mu
+// but are read without it, so requests for the resource need not wait on a generation.
 type resource struct {
-	size int64
-	mu   sync.Mutex
+	size    atomic.Int64
+	mu      sync.Mutex
+	flagged atomic.Bool
+}
+
+func newResource(size int64) *resource {
+	r := &resource{atomic.Int64{}, sync.Mutex{}, atomic.Bool{}}
+	r.size.Store(size)
+
+	return r
 }
 
 type defaultSite struct {
-	gemini      *gemini.Client
+	provider    Provider
 	resources   map[string]*resource
 	prompter    Prompter
 	root        *os.Root
 	rootPath    string
+	policy      *sanitize.Policy
+	headers     *SecurityHeaders
+	moderator   Moderator
 	transformer HTMLTransformer
+	budget      Budget
+	metrics     *Metrics
 	links       string
+	usage       generation.Usage
 	mu          sync.Mutex
-	unsafe      bool
+	unsafe      atomic.Bool
 }
 
 func (s *defaultSite) Handle(slug string) (HandleFunc, GenerateFunc, error) {
-	if s.unsafe {
+	if s.unsafe.Load() {
 		return nil, nil, ErrUnsafe
 	}
 
@@ -93,14 +149,26 @@ func (s *defaultSite) Handle(slug string) (HandleFunc, GenerateFunc, error) {
 		return nil, nil, err
 	}
 
-	if r.size > 0 {
-		return s.handleFile(slug, r.size), nil, nil
+	if r.flagged.Load() {
+		return nil, nil, fmt.Errorf("%w: %s", ErrFlagged, slug)
+	}
+
+	size := r.size.Load()
+	if size > 0 {
+		return s.handleFile(slug, size), nil, nil
 	}
 
 	return s.handleGenerate(slug)
 }
 
 func (s *defaultSite) handleGenerate(slug string) (HandleFunc, GenerateFunc, error) {
+	if s.budget != nil {
+		err := s.budget.Allow()
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
 	handleFunc := func(w http.ResponseWriter) error {
 		w.Header().Set("Content-Type", contentTypeForSlug(slug))
 		w.WriteHeader(http.StatusAccepted)
@@ -113,39 +181,81 @@ func (s *defaultSite) handleGenerate(slug string) (HandleFunc, GenerateFunc, err
 		return nil
 	}
 
-	generateFunc := func(ctx context.Context, progress func(string)) HandleFunc {
+	generateFunc := func(ctx context.Context, progress func(string)) (HandleFunc, error) {
 		r, err := s.getResource(slug)
 		if err != nil {
 			return func(w http.ResponseWriter) error {
 				http.Error(w, fmt.Sprintf("failed to initResources %s: %v", slug, err), http.StatusInternalServerError)
 				return nil
-			}
+			}, err
 		}
 
 		r.mu.Lock()
 		defer r.mu.Unlock()
 
-		if r.size > 0 {
-			return s.handleFile(slug, r.size)
+		size := r.size.Load()
+		if size > 0 {
+			return s.handleFile(slug, size), nil
+		}
+
+		if r.flagged.Load() {
+			err = fmt.Errorf("%w: %s", ErrFlagged, slug)
+
+			return func(_ http.ResponseWriter) error {
+				return err
+			}, err
+		}
+
+		// the budget may have run out while this was queued
+		if s.budget != nil {
+			err = s.budget.Allow()
+			if err != nil {
+				return func(_ http.ResponseWriter) error {
+					return err
+				}, err
+			}
+		}
+
+		collector := &usageCollector{generation.Usage{InputTokens: 0, OutputTokens: 0, Images: 0}, sync.Mutex{}}
+
+		usageCtx := generation.WithUsage(ctx, collector.add)
+
+		v, urls, err := s.generate(usageCtx, slug, progress)
+		if err == nil {
+			err = s.moderate(usageCtx, slug, v, progress)
+		}
+
+		// the generation is paid for either way, so failing to count it is no reason to throw it away
+		usageErr := s.recordUsage(ctx, slug, collector.get(), err == nil)
+		if usageErr != nil {
+			slog.WarnContext(ctx, "failed to record usage", "slug", slug, "error", usageErr)
 		}
 
-		v, err := s.generate(ctx, slug, progress)
 		if err != nil {
 			if errors.Is(err, ErrUnsafe) {
-				s.unsafe = true
+				// a flagged page or image is refused until restart, when it may come out differently
+				if errors.Is(err, ErrFlagged) {
+					r.flagged.Store(true)
+				} else {
+					s.unsafe.Store(true)
+				}
 
 				return func(_ http.ResponseWriter) error {
 					return err
-				}
+				}, err
 			}
 
 			return func(w http.ResponseWriter) error {
 				http.Error(w, fmt.Sprintf("failed to generate %s: %v", slug, err), http.StatusInternalServerError)
 				return nil
-			}
+			}, err
+		}
+
+		err = s.recordLinks(urls)
+		if err == nil {
+			err = writeFileAtomic(ctx, s.root, s.rootPath, slug, v)
 		}
 
-		err = writeFileAtomic(s.root, s.rootPath, slug, v)
 		if err != nil {
 			return func(w http.ResponseWriter) error {
 				http.Error(
@@ -154,31 +264,42 @@ func (s *defaultSite) handleGenerate(slug string) (HandleFunc, GenerateFunc, err
 					http.StatusInternalServerError)
 
 				return nil
-			}
+			}, err
 		}
 
-		r.size = int64(len(v))
+		r.size.Store(int64(len(v)))
 
 		return func(w http.ResponseWriter) error {
-			w.Header().Set("Content-Length", strconv.FormatInt(r.size, 10))
+			w.Header().Set("Content-Length", strconv.Itoa(len(v)))
 			w.Header().Set("Content-Type", contentTypeForSlug(slug))
 			w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+			s.headers.set(w.Header())
+
+			n, err := w.Write(v)
+
+			s.metrics.serve(slug, int64(n))
 
-			_, err := w.Write(v)
 			if err != nil {
 				return fmt.Errorf("failed to write response: %w", err)
 			}
 
 			return nil
-		}
+		}, nil
 	}
 
 	return handleFunc, generateFunc, nil
 }
 
-func (s *defaultSite) generate(ctx context.Context, slug string, progress func(string)) ([]byte, error) {
+// generate returns a new page or image, and for pages the URLs it links to.
+func (s *defaultSite) generate(
+	ctx context.Context,
+	slug string,
+	progress func(string),
+) ([]byte, map[string]struct{}, error) {
 	var v []byte
 
+	var urls map[string]struct{}
+
 	progress(fmt.Sprintf("Generating %s...\n", slug))
 
 	s.mu.Lock()
@@ -187,27 +308,82 @@ func (s *defaultSite) generate(ctx context.Context, slug string, progress func(s
 
 	prompt, err := s.prompter.GetPromptForSlug(ctx, slug, links, progress)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get prompt for %s: %w", slug, err)
+		return nil, nil, fmt.Errorf("failed to get prompt for %s: %w", slug, err)
 	}
 
+	start := time.Now()
+
 	switch extensionForSlug(slug) {
 	case ExtensionHTML:
-		v, err = s.generateHTML(ctx, prompt, progress)
+		v, urls, err = s.generateHTML(ctx, prompt, progress)
+		s.metrics.generated(KindHTML, start, err)
 	case ExtensionJPG:
 		v, err = s.generateJPG(ctx, prompt, progress)
+		s.metrics.generated(KindJPG, start, err)
 	default:
 		panic(errorInvalidSlug(slug))
 	}
 
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	if len(v) == 0 {
-		return nil, fmt.Errorf("%w: %s %d", ErrUnexpectedSize, slug, len(v))
+		return nil, nil, fmt.Errorf("%w: %s %d", ErrUnexpectedSize, slug, len(v))
 	}
 
-	return v, nil
+	return v, urls, nil
+}
+
+// moderate reviews a generated page or image with s.moderator, if any, returning an error wrapping ErrFlagged if it
+// must not be kept.
+func (s *defaultSite) moderate(ctx context.Context, slug string, v []byte, progress func(string)) error {
+	if s.moderator == nil {
+		return nil
+	}
+
+	progress(fmt.Sprintf("\nReviewing %s...\n", slug))
+
+	start := time.Now()
+	ctx, span := tracing.Start(ctx, "moderate")
+
+	var err error
+
+	switch extensionForSlug(slug) {
+	case ExtensionHTML:
+		var text string
+
+		text, err = pageText(v)
+		if err == nil {
+			err = s.moderator.ModerateText(ctx, text)
+		}
+	case ExtensionJPG:
+		var img image.Image
+
+		img, err = jpeg.Decode(bytes.NewReader(v))
+		if err == nil {
+			err = s.moderator.ModerateImage(ctx, img)
+		}
+	default:
+		panic(errorInvalidSlug(slug))
+	}
+
+	tracing.End(span, err)
+
+	if errors.Is(err, ErrFlagged) {
+		s.metrics.generated(KindModeration, start, nil)
+		s.metrics.flagged(slug)
+
+		return err
+	}
+
+	s.metrics.generated(KindModeration, start, err)
+
+	if err != nil {
+		return fmt.Errorf("failed to moderate %s: %w", slug, err)
+	}
+
+	return nil
 }
 
 func (s *defaultSite) getResource(slug string) (*resource, error) {
@@ -232,8 +408,15 @@ func (s *defaultSite) getResource(slug string) (*resource, error) {
 func (s *defaultSite) initResources() error {
 	s.resources = make(map[string]*resource, 2)
 
-	s.resources[IndexSlug] = &resource{0, sync.Mutex{}}
-	s.resources[NotFoundSlug] = &resource{0, sync.Mutex{}}
+	s.resources[IndexSlug] = newResource(0)
+	s.resources[NotFoundSlug] = newResource(0)
+
+	usage, err := ReadUsage(s.root, UsageJSON)
+	if err != nil {
+		return err
+	}
+
+	s.usage = usage
 
 	f, err := s.root.Open(LinksTXT)
 	if err != nil {
@@ -266,7 +449,7 @@ func (s *defaultSite) initResources() error {
 			size = stat.Size()
 		}
 
-		s.resources[line] = &resource{size, sync.Mutex{}}
+		s.resources[line] = newResource(size)
 	}
 
 	return nil
@@ -282,8 +465,16 @@ func (s *defaultSite) handleFile(slug string, size int64) func(http.ResponseWrit
 		w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
 		w.Header().Set("Content-Type", contentTypeForSlug(slug))
 		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+		s.headers.set(w.Header())
 
 		n, err := io.Copy(w, f)
+
+		// a ProgressWriter finishing up reads the response itself, the client never receives it
+		_, finishing := w.(*dummyResponseWriter)
+		if !finishing {
+			s.metrics.serve(slug, n)
+		}
+
 		if err != nil {
 			return fmt.Errorf("failed to copy file %s: %w", slug, err)
 		}
@@ -296,42 +487,35 @@ func (s *defaultSite) handleFile(slug string, size int64) func(http.ResponseWrit
 	}
 }
 
-func (s *defaultSite) generateHTML(ctx context.Context, prompt string, progress func(string)) ([]byte, error) {
-	doc, err := s.gemini.HTML(ctx, prompt, progress)
+func (s *defaultSite) generateHTML(
+	ctx context.Context,
+	prompt Prompt,
+	progress func(string),
+) ([]byte, map[string]struct{}, error) {
+	doc, err := s.provider.HTML(ctx, prompt.Text, prompt.Options, progress)
 	if err != nil {
-		return nil, fmt.Errorf("provider.HTML failed: %w", err)
+		return nil, nil, fmt.Errorf("provider.HTML failed: %w", err)
 	}
 
 	urls := make(map[string]struct{})
 
-	err = sanitize.HTMLSanitizeAndExtractUrls(doc, urls, sanitizeURL)
-	if err != nil {
-		return nil, err
-	}
+	_, span := tracing.Start(ctx, "sanitize")
 
-	if s.transformer != nil {
-		err = s.transformer(doc, urls)
-		if err != nil {
-			return nil, fmt.Errorf("transformer failed: %w", err)
-		}
+	err = sanitize.HTMLSanitizeWithPolicy(doc, s.policy)
+	if err == nil {
+		err = sanitize.HTMLSanitizeAndExtractUrls(doc, urls, sanitizeURL)
 	}
 
-	var sb strings.Builder
-
-	for u := range urls {
-		_, ok := s.resources[u]
-		if !ok {
-			sb.WriteString(u)
-			sb.WriteString("\n")
+	tracing.End(span, err)
 
-			s.resources[u] = &resource{0, sync.Mutex{}}
-		}
+	if err != nil {
+		return nil, nil, err
 	}
 
-	if sb.Len() > 0 {
-		err = appendContents(s.root, LinksTXT, []byte(sb.String()))
+	if s.transformer != nil {
+		err = s.transformer(doc, urls)
 		if err != nil {
-			return nil, err
+			return nil, nil, fmt.Errorf("transformer failed: %w", err)
 		}
 	}
 
@@ -339,31 +523,42 @@ func (s *defaultSite) generateHTML(ctx context.Context, prompt string, progress
 
 	err = html.Render(&buf, doc)
 	if err != nil {
-		return nil, fmt.Errorf("failed to render HTML: %w", err)
+		return nil, nil, fmt.Errorf("failed to render HTML: %w", err)
 	}
 
 	v := buf.Bytes()
 
-	return v, nil
+	return v, urls, nil
 }
 
-func (s *defaultSite) generateJPG(ctx context.Context, prompt string, progress func(string)) ([]byte, error) {
-	var raw []byte
-	var err error
+// recordLinks adds the pages and images a generated page links to, so they can be generated in turn.
+func (s *defaultSite) recordLinks(urls map[string]struct{}) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-	for attempt := range 3 {
-		raw, err = s.gemini.PNG(ctx, prompt, progress)
-		if err == nil {
-			break
-		}
+	var sb strings.Builder
+
+	for u := range urls {
+		_, ok := s.resources[u]
+		if !ok {
+			sb.WriteString(u)
+			sb.WriteString("\n")
 
-		if attempt < 2 {
-			progress(fmt.Sprintf("PNG generation failed (attempt %d/3), retrying...\n", attempt+1))
+			s.resources[u] = newResource(0)
 		}
 	}
 
+	if sb.Len() == 0 {
+		return nil
+	}
+
+	return appendContents(s.root, LinksTXT, []byte(sb.String()))
+}
+
+func (s *defaultSite) generateJPG(ctx context.Context, prompt Prompt, progress func(string)) ([]byte, error) {
+	raw, err := s.provider.PNG(ctx, prompt.Text, prompt.Options, progress)
 	if err != nil {
-		return nil, fmt.Errorf("provider.PNG failed after 3 attempts: %w", err)
+		return nil, fmt.Errorf("provider.PNG failed: %w", err)
 	}
 
 	img, err := png.Decode(bytes.NewReader(raw))
@@ -0,0 +1,329 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image"
+	"image/png"
+	"io"
+	"net/http"
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/jasonthorsness/ginprov/generation"
+	"golang.org/x/net/html"
+)
+
+type stubProvider struct {
+	page string
+	text string
+}
+
+func (p *stubProvider) HTML(
+	ctx context.Context,
+	_ string,
+	_ generation.Options,
+	progress func(string),
+) (*html.Node, error) {
+	generation.ReportUsage(ctx, generation.Usage{InputTokens: 10, OutputTokens: 20, Images: 0})
+	progress(p.page)
+	return html.Parse(strings.NewReader(p.page))
+}
+
+func (p *stubProvider) PNG(_ context.Context, _ string, _ generation.Options, _ func(string)) ([]byte, error) {
+	var buf bytes.Buffer
+
+	err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 4, 4)))
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (p *stubProvider) Text(_ context.Context, prompt string, _ generation.Options, _ func(string)) (string, error) {
+	if strings.Contains(prompt, generation.SafetyRequest) {
+		return generation.Safe, nil
+	}
+
+	return p.text, nil
+}
+
+// newTestSite returns a Site generating into a temporary directory. Moderator may be nil to keep everything.
+func newTestSite(t *testing.T, provider Provider, moderator Moderator) (Site, *os.Root) {
+	t.Helper()
+
+	dir := t.TempDir()
+
+	root, err := os.OpenRoot(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { _ = root.Close() })
+
+	prompter := NewPrompter(provider, "test-site", root, dir, nil)
+
+	return NewSite(provider, prompter, root, dir, nil, nil, moderator, nil, nil, nil), root
+}
+
+func TestSiteGenerate(t *testing.T) {
+	t.Parallel()
+
+	provider := &stubProvider{
+		page: `<html><body><a href="Other Page.html" onclick="alert(1)">x</a><img src="/photo.png">` +
+			`<script>alert(2)</script></body></html>`,
+		text: "outline",
+	}
+
+	site, root := newTestSite(t, provider, nil)
+
+	_, generateFunc, err := site.Handle(IndexSlug)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if generateFunc == nil {
+		t.Fatal("expected generateFunc for missing index")
+	}
+
+	var progress strings.Builder
+
+	handleFunc, err := generateFunc(context.Background(), func(v string) { progress.WriteString(v) })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := &dummyResponseWriter{headers: make(http.Header), body: []byte{}, code: 0}
+
+	err = handleFunc(w)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(string(w.body), `href="other-page.html"`) {
+		t.Errorf("expected sanitized link in body, got %q", w.body)
+	}
+
+	if strings.Contains(string(w.body), "alert") {
+		t.Errorf("expected scripts and event handlers to be removed, got %q", w.body)
+	}
+
+	if !strings.Contains(progress.String(), "Generating index.html") {
+		t.Errorf("expected progress output, got %q", progress.String())
+	}
+
+	f, err := root.Open(LinksTXT)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	links, err := io.ReadAll(f)
+	_ = f.Close()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{"other-page.html", "photo.jpg"} {
+		if !strings.Contains(string(links), want) {
+			t.Errorf("expected %s in %s, got %q", want, LinksTXT, links)
+		}
+	}
+
+	usage, err := ReadUsage(root, IndexSlug+ExtensionUsage)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if usage.InputTokens != 10 || usage.OutputTokens != 20 {
+		t.Errorf("unexpected usage for %s: %+v", IndexSlug, usage)
+	}
+
+	handleFunc, generateFunc, err = site.Handle("photo.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if generateFunc == nil || handleFunc == nil {
+		t.Fatal("expected photo.jpg to be generated")
+	}
+
+	handleFunc, err = generateFunc(context.Background(), func(string) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w = &dummyResponseWriter{headers: make(http.Header), body: []byte{}, code: 0}
+
+	err = handleFunc(w)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if w.headers.Get("Content-Type") != ContentTypeJPG || len(w.body) == 0 {
+		t.Errorf("expected JPG response, got %q with %d bytes", w.headers.Get("Content-Type"), len(w.body))
+	}
+}
+
+func TestSiteUnsafe(t *testing.T) {
+	t.Parallel()
+
+	site, _ := newTestSite(t, &unsafeProvider{}, nil)
+
+	_, generateFunc, err := site.Handle(IndexSlug)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handleFunc, err := generateFunc(context.Background(), func(string) {})
+	if !errors.Is(err, ErrUnsafe) {
+		t.Fatalf("expected ErrUnsafe, got %v", err)
+	}
+
+	w := &dummyResponseWriter{headers: make(http.Header), body: []byte{}, code: 0}
+
+	err = handleFunc(w)
+	if !errors.Is(err, ErrUnsafe) {
+		t.Fatalf("expected the handler to report ErrUnsafe, got %v", err)
+	}
+
+	_, _, err = site.Handle(IndexSlug)
+	if !errors.Is(err, ErrUnsafe) {
+		t.Fatal("expected site to be marked unsafe")
+	}
+}
+
+func TestSiteUsageWriteFails(t *testing.T) {
+	t.Parallel()
+
+	site, root := newTestSite(t, &stubProvider{"<html><body>hi</body></html>", "outline"}, nil)
+
+	// nothing can be renamed over a directory
+	err := root.Mkdir(IndexSlug+ExtensionUsage, 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, generateFunc, err := site.Handle(IndexSlug)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = generateFunc(context.Background(), func(string) {})
+	if err != nil {
+		t.Fatalf("expected the page despite failing to record usage, got %v", err)
+	}
+
+	_, err = root.Stat(IndexSlug)
+	if err != nil {
+		t.Errorf("expected the page to be saved: %v", err)
+	}
+
+	usage, err := ReadUsage(root, UsageJSON)
+	if err != nil || usage.InputTokens == 0 {
+		t.Errorf("expected the site total to be recorded anyway, got %+v, %v", usage, err)
+	}
+}
+
+// overridingPrompter asks for every slug with the same options.
+type overridingPrompter struct {
+	options generation.Options
+}
+
+func (p overridingPrompter) GetPromptForSlug(_ context.Context, slug, _ string, _ func(string)) (Prompt, error) {
+	return Prompt{"a prompt for " + slug, p.options}, nil
+}
+
+// optionsProvider records the options of every page and image it is asked for.
+type optionsProvider struct {
+	stubProvider
+	options []generation.Options
+}
+
+func (p *optionsProvider) HTML(
+	ctx context.Context,
+	prompt string,
+	options generation.Options,
+	progress func(string),
+) (*html.Node, error) {
+	p.options = append(p.options, options)
+	return p.stubProvider.HTML(ctx, prompt, options, progress)
+}
+
+func (p *optionsProvider) PNG(
+	ctx context.Context,
+	prompt string,
+	options generation.Options,
+	progress func(string),
+) ([]byte, error) {
+	p.options = append(p.options, options)
+	return p.stubProvider.PNG(ctx, prompt, options, progress)
+}
+
+func TestSitePromptOptions(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+
+	root, err := os.OpenRoot(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { _ = root.Close() })
+
+	temperature := float32(0.2)
+	options := generation.Options{Model: "per-request", Temperature: &temperature}
+
+	provider := &optionsProvider{stubProvider{`<html><body><img src="photo.jpg"></body></html>`, "outline"}, nil}
+	site := NewSite(provider, overridingPrompter{options}, root, dir, nil, nil, nil, nil, nil, nil)
+
+	for _, slug := range []string{IndexSlug, "photo.jpg"} {
+		_, generateFunc, err := site.Handle(slug)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = generateFunc(context.Background(), func(string) {})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if !reflect.DeepEqual(provider.options, []generation.Options{options, options}) {
+		t.Errorf("expected the prompter's options for the page and the image, got %+v", provider.options)
+	}
+}
+
+type unsafeProvider struct {
+	stubProvider
+}
+
+func (p *unsafeProvider) Text(_ context.Context, _ string, _ generation.Options, _ func(string)) (string, error) {
+	return "UNSAFE", nil
+}
+
+// FuzzSanitizeURL checks that every URL becomes "data:" or a slug, and that a slug is left as it is.
+func FuzzSanitizeURL(f *testing.F) {
+	slug := regexp.MustCompile(`^[a-z0-9]+(-+[a-z0-9]+)*\.(html|jpg)$`)
+
+	f.Fuzz(func(t *testing.T, v string) {
+		got := sanitizeURL(v)
+		if got == "data:" {
+			return
+		}
+
+		if !slug.MatchString(got) {
+			t.Fatalf("sanitizeURL(%q) = %q, expected data: or a slug", v, got)
+		}
+
+		if again := sanitizeURL(got); again != got {
+			t.Errorf("sanitizeURL(%q) = %q, expected the slug unchanged", got, again)
+		}
+	})
+}
@@ -0,0 +1,101 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/jasonthorsness/ginprov/generation"
+)
+
+const (
+	// UsageJSON holds the total usage of a site, including generations that failed.
+	UsageJSON = "usage.json"
+	// ExtensionUsage is appended to a slug to name the file holding the usage of its generation.
+	ExtensionUsage = ".usage.json"
+)
+
+type usageCollector struct {
+	usage generation.Usage
+	mu    sync.Mutex
+}
+
+func (c *usageCollector) add(u generation.Usage) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.usage.Add(u)
+}
+
+func (c *usageCollector) get() generation.Usage {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.usage
+}
+
+// ReadUsage reads a usage file written by a Site. A missing file is reported as zero usage.
+func ReadUsage(root *os.Root, name string) (generation.Usage, error) {
+	var u generation.Usage
+
+	f, err := root.Open(name)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return u, nil
+		}
+
+		return u, fmt.Errorf("failed to open %s: %w", name, err)
+	}
+
+	defer func() {
+		_ = f.Close() // read only
+	}()
+
+	v, err := io.ReadAll(f)
+	if err != nil {
+		return u, fmt.Errorf("failed to read %s: %w", name, err)
+	}
+
+	err = json.Unmarshal(v, &u)
+	if err != nil {
+		return u, fmt.Errorf("failed to decode %s: %w", name, err)
+	}
+
+	return u, nil
+}
+
+// recordUsage adds u to the site total and budget and, if the slug was generated, records u next to it. Every write
+// is attempted even if an earlier one fails.
+func (s *defaultSite) recordUsage(ctx context.Context, slug string, u generation.Usage, generated bool) error {
+	var errs []error
+
+	if s.budget != nil {
+		errs = append(errs, s.budget.Spend(u))
+	}
+
+	if generated {
+		errs = append(errs, writeUsage(ctx, s.root, s.rootPath, slug+ExtensionUsage, u))
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.usage.Add(u)
+
+	errs = append(errs, writeUsage(ctx, s.root, s.rootPath, UsageJSON, s.usage))
+
+	return errors.Join(errs...)
+}
+
+func writeUsage(ctx context.Context, root *os.Root, rootPath string, name string, u generation.Usage) error {
+	v, err := json.Marshal(u)
+	if err != nil {
+		return fmt.Errorf("failed to encode %s: %w", name, err)
+	}
+
+	return writeFileAtomic(ctx, root, rootPath, name, v)
+}
@@ -2,20 +2,121 @@ package server
 
 import (
 	"context"
+	"fmt"
+	"slices"
 	"sync"
+	"time"
+
+	"github.com/jasonthorsness/ginprov/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
-// WorkerPool is a fixed-size pool of workers for arbitrary work. Incoming work is enqueued in a FIFO channel which
-// the individual workers pull from.
+// WorkerPool is a fixed-size pool of workers for arbitrary work. Incoming work waits in a queue per priority which
+// the individual workers pull from, taking turns between groups such as sites so a busy one cannot crowd out the
+// rest. Queued work can be told its position and when it is expected to start, based on how long recent work took.
 type WorkerPool struct {
-	workCh chan workWrapper
-	wg     sync.WaitGroup
+	queues   [numPriorities]groupQueue
+	running  map[string]int
+	waiting  map[string]int
+	weights  []int
+	credits  []int
+	notes    []func()
+	average  time.Duration
+	limits   GroupLimits
+	queued   int
+	capacity int
+	workers  int
+	busy     int
+	closed   bool
+	drained  bool
+	mu       sync.Mutex
+	workCond sync.Cond
+	noteCond sync.Cond
+	wg       sync.WaitGroup
+	notesWg  sync.WaitGroup
+}
+
+// Priority classes work so interactive page loads are not held up by less urgent work.
+type Priority int
+
+const (
+	PriorityInteractiveHTML Priority = iota
+	PriorityInteractiveImage
+	PriorityBackground
+	numPriorities
+)
+
+// GroupLimits caps the work of each group. Zero means no limit.
+type GroupLimits struct {
+	// Workers is how many workers a group may occupy at once.
+	Workers int
+	// Queued is how much work a group may have waiting.
+	Queued int
+}
+
+// WorkOptions are optional settings for work passed to DoWork.
+type WorkOptions struct {
+	// Queued, if not nil, is called whenever the work is waiting for a busy pool and its place in the queue changes,
+	// with how many items are ahead of it and when it is expected to start. The start is zero until the pool has
+	// timed some work. Calls are made in order from a pool goroutine, never from DoWork itself. The place assumes
+	// strict priority and no group limits, so with either the work may start sooner or later than reported.
+	Queued func(ahead int, start time.Time)
+	// Group is what the work is limited and takes turns by, such as the site it is for.
+	Group    string
+	Priority Priority
+}
+
+type job struct {
+	ctx      context.Context
+	do       func(context.Context, any)
+	work     any
+	queued   func(ahead int, start time.Time)
+	group    string
+	priority Priority
+	ahead    int
+	wait     trace.Span
 }
 
-// NewWorkerPool starts a new worker pool with the specified number of workers and work channel capacity.
-// Arguments must both be positive numbers.
-func NewWorkerPool(numWorkers, workChannelCapacity int) *WorkerPool {
-	w := &WorkerPool{make(chan workWrapper, workChannelCapacity), sync.WaitGroup{}}
+// Ticket refers to work accepted by DoWork.
+type Ticket struct {
+	w *WorkerPool
+	j *job
+}
+
+// NewWorkerPool starts a new worker pool with the specified number of workers and work queue capacity, which must
+// both be positive numbers. With nil weights, scheduling is strict: work only starts when no higher priority work
+// is waiting. Otherwise weights has a positive entry per priority, highest first, and when several priorities are
+// waiting each gets that many starts per round.
+func NewWorkerPool(numWorkers, workQueueCapacity int, weights []int, limits GroupLimits) *WorkerPool {
+	if weights != nil && (len(weights) != int(numPriorities) || slices.Min(weights) < 1) {
+		panic("weights must have a positive entry per priority")
+	}
+
+	w := &WorkerPool{
+		[numPriorities]groupQueue{},
+		make(map[string]int),
+		make(map[string]int),
+		weights,
+		slices.Clone(weights),
+		nil,
+		0,
+		limits,
+		0,
+		workQueueCapacity,
+		numWorkers,
+		0,
+		false,
+		false,
+		sync.Mutex{},
+		sync.Cond{},
+		sync.Cond{},
+		sync.WaitGroup{},
+		sync.WaitGroup{},
+	}
+
+	w.workCond.L = &w.mu
+	w.noteCond.L = &w.mu
 
 	for range numWorkers {
 		w.wg.Add(1)
@@ -23,12 +124,17 @@ func NewWorkerPool(numWorkers, workChannelCapacity int) *WorkerPool {
 		go w.workerLoop()
 	}
 
+	w.notesWg.Add(1)
+
+	go w.noteLoop()
+
 	return w
 }
 
 // DoWork queues work to the pool for asynchronous execution.
 // 1. DoWork returns immediately often but not necessarily before do() is called.
-// 2. If the work queue is full, do() is not called and the function returns false.
+// 2. If the work queue is full, or the group already has its limit waiting, do() is not called and the function
+// returns nil.
 // 3. Otherwise, do() will be called exactly once.
 // 4. do() must not panic, if it does the panic will escape and the program will terminate.
 func DoWork[TWork any](
@@ -36,17 +142,114 @@ func DoWork[TWork any](
 	w *WorkerPool,
 	work TWork,
 	do func(context.Context, TWork),
-) bool {
-	return trySend(w.workCh, workWrapper{ctx, wrapDo(do), work})
+	options WorkOptions,
+) *Ticket {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed || w.queued >= w.capacity {
+		return nil
+	}
+
+	if w.limits.Queued > 0 && w.waiting[options.Group] >= w.limits.Queued {
+		return nil
+	}
+
+	_, wait := tracing.Start(ctx, "queue.wait",
+		attribute.String("group", options.Group),
+		attribute.Int("priority", int(options.Priority)))
+
+	j := &job{ctx, wrapDo(do), work, options.Queued, options.Group, options.Priority, -1, wait}
+
+	w.queues[j.priority].push(j)
+	w.queued++
+	w.waiting[j.group]++
+
+	w.notifyQueued()
+	w.workCond.Signal()
+
+	return &Ticket{w, j}
+}
+
+// Raise moves the work to priority p if it is still waiting at a lower priority, such as when a user asks for a
+// page that was being prefetched.
+func (t *Ticket) Raise(p Priority) {
+	w := t.w
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if p >= t.j.priority {
+		return
+	}
+
+	if !w.queues[t.j.priority].remove(t.j) {
+		return // already started
+	}
+
+	t.j.priority = p
+	w.queues[p].push(t.j)
+
+	w.notifyQueued()
 }
 
 // Close stops the pool from accepting work and blocks until do returns for all pending work.
 // It always returns nil but has error signature to conform to io.Closer.
 func (w *WorkerPool) Close() error {
-	close(w.workCh)
-	w.wg.Wait()
+	return w.Shutdown(context.Background())
+}
+
+// Shutdown stops the pool from accepting work and blocks until do returns for all pending work or ctx is done. In
+// the latter case it returns the context's error and pending work carries on in the background.
+func (w *WorkerPool) Shutdown(ctx context.Context) error {
+	w.mu.Lock()
+	w.closed = true
+	w.workCond.Broadcast()
+	w.mu.Unlock()
+
+	done := make(chan struct{})
+
+	go func() {
+		w.wg.Wait()
 
-	return nil
+		w.mu.Lock()
+		w.drained = true
+		w.noteCond.Broadcast()
+		w.mu.Unlock()
+
+		w.notesWg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("worker pool shutdown: %w", ctx.Err())
+	}
+}
+
+// WorkerPoolStats is a snapshot of how loaded a WorkerPool is.
+type WorkerPoolStats struct {
+	Queued   int
+	Capacity int
+	Busy     int
+	Workers  int
+}
+
+func (w *WorkerPool) Stats() WorkerPoolStats {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return WorkerPoolStats{w.queued, w.capacity, w.busy, w.workers}
+}
+
+// isClosed reports whether the pool has stopped accepting work.
+func (w *WorkerPool) isClosed() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.closed
 }
 
 func wrapDo[TWork any](do func(context.Context, TWork)) func(context.Context, any) {
@@ -55,22 +258,282 @@ func wrapDo[TWork any](do func(context.Context, TWork)) func(context.Context, an
 	}
 }
 
-type workWrapper struct {
-	ctx  context.Context
-	do   func(context.Context, any)
-	work any
-}
-
 func (w *WorkerPool) workerLoop() {
 	defer w.wg.Done()
 
 	for {
-		r, ok := <-w.workCh
+		j, ok := w.next()
 		if !ok {
 			break
 		}
 
-		r.do(r.ctx, r.work)
+		start := time.Now()
+
+		j.do(j.ctx, j.work)
+
+		w.finish(j, time.Since(start))
+	}
+}
+
+// next blocks until there is work this worker may start, returning false once the pool is closed and drained.
+func (w *WorkerPool) next() (*job, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for {
+		j, ok := w.take()
+		if ok {
+			w.queued--
+			w.busy++
+			w.running[j.group]++
+
+			w.waiting[j.group]--
+			if w.waiting[j.group] == 0 {
+				delete(w.waiting, j.group)
+			}
+
+			w.notifyQueued()
+
+			j.wait.End()
+
+			return j, true
+		}
+
+		if w.closed && w.queued == 0 {
+			return nil, false
+		}
+
+		// nothing is queued, or every group with queued work is at its limit until some of it finishes
+		w.workCond.Wait()
+	}
+}
+
+// take removes the next work to start, if there is any that may start. w.mu must be held.
+func (w *WorkerPool) take() (*job, bool) {
+	eligible := func(group string) bool {
+		return w.limits.Workers <= 0 || w.running[group] < w.limits.Workers
+	}
+
+	if w.weights == nil {
+		for p := range numPriorities {
+			j, ok := w.queues[p].pop(eligible)
+			if ok {
+				return j, true
+			}
+		}
+
+		return nil, false
+	}
+
+	// if no priority with credit has work that may start, refill for a new round and look once more
+	for range 2 {
+		for p := range numPriorities {
+			if w.credits[p] == 0 {
+				continue
+			}
+
+			j, ok := w.queues[p].pop(eligible)
+			if ok {
+				w.credits[p]--
+				return j, true
+			}
+		}
+
+		copy(w.credits, w.weights)
+	}
+
+	return nil, false
+}
+
+func (w *WorkerPool) finish(j *job, d time.Duration) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.busy--
+
+	w.running[j.group]--
+	if w.running[j.group] == 0 {
+		delete(w.running, j.group)
+	}
+
+	// an exponentially weighted moving average favors recent work
+	const weight = 8
+
+	if w.average == 0 {
+		w.average = d
+	} else {
+		w.average += (d - w.average) / weight
+	}
+
+	// work held back by its group limit may start now
+	if w.limits.Workers > 0 {
+		w.workCond.Broadcast()
+	}
+}
+
+// notifyQueued schedules Queued calls for work whose place in line has changed. w.mu must be held.
+func (w *WorkerPool) notifyQueued() {
+	idle := w.workers - w.busy
+	now := time.Now()
+	i := 0
+
+	for p := range numPriorities {
+		w.queues[p].each(func(j *job) {
+			ahead := i - idle
+			i++
+
+			if j.queued == nil || ahead < 0 || ahead == j.ahead {
+				return
+			}
+
+			j.ahead = ahead
+
+			var start time.Time
+			if w.average > 0 {
+				start = now.Add(w.average * time.Duration(ahead+1) / time.Duration(w.workers))
+			}
+
+			w.notes = append(w.notes, func() { j.queued(ahead, start) })
+		})
+	}
+
+	if len(w.notes) > 0 {
+		w.noteCond.Signal()
+	}
+}
+
+// noteLoop makes the Queued calls so they never run under w.mu or on the caller of DoWork.
+func (w *WorkerPool) noteLoop() {
+	defer w.notesWg.Done()
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for {
+		for len(w.notes) == 0 && !w.drained {
+			w.noteCond.Wait()
+		}
+
+		if len(w.notes) == 0 {
+			return
+		}
+
+		notes := w.notes
+		w.notes = nil
+
+		w.mu.Unlock()
+
+		for _, note := range notes {
+			note()
+		}
+
+		w.mu.Lock()
+	}
+}
+
+// groupQueue holds the waiting work of one priority as a FIFO queue per group, serving the groups in turn.
+type groupQueue struct {
+	jobs  map[string][]*job
+	order []string
+	next  int
+}
+
+func (q *groupQueue) push(j *job) {
+	if q.jobs == nil {
+		q.jobs = make(map[string][]*job)
+	}
+
+	if len(q.jobs[j.group]) == 0 {
+		q.order = append(q.order, j.group)
+	}
+
+	q.jobs[j.group] = append(q.jobs[j.group], j)
+}
+
+// pop removes the oldest work of the next group in turn that eligible allows.
+func (q *groupQueue) pop(eligible func(group string) bool) (*job, bool) {
+	for n := range len(q.order) {
+		i := (q.next + n) % len(q.order)
+		group := q.order[i]
+
+		if !eligible(group) {
+			continue
+		}
+
+		jobs := q.jobs[group]
+		j := jobs[0]
+
+		if len(jobs) == 1 {
+			q.drop(i)
+		} else {
+			jobs[0] = nil
+			q.jobs[group] = jobs[1:]
+			q.next = (i + 1) % len(q.order)
+		}
+
+		return j, true
+	}
+
+	return nil, false
+}
+
+// remove takes j out of the queue, returning false if it is not waiting.
+func (q *groupQueue) remove(j *job) bool {
+	jobs := q.jobs[j.group]
+
+	i := slices.Index(jobs, j)
+	if i < 0 {
+		return false
+	}
+
+	if len(jobs) > 1 {
+		q.jobs[j.group] = slices.Delete(jobs, i, i+1)
+		return true
+	}
+
+	next := q.next
+	k := slices.Index(q.order, j.group)
+
+	q.drop(k)
+
+	// removing a group other than the one up next keeps the turn where it was
+	if k < next {
+		q.next = next - 1
+	} else if k > next {
+		q.next = next
+	}
+
+	return true
+}
+
+// drop forgets the group at order[i], which has nothing left waiting, passing its turn to the group after it.
+func (q *groupQueue) drop(i int) {
+	delete(q.jobs, q.order[i])
+	q.order = slices.Delete(q.order, i, i+1)
+
+	q.next = i
+	if q.next >= len(q.order) {
+		q.next = 0
+	}
+}
+
+// each calls f for the waiting work in the order it would start, ignoring group limits.
+func (q *groupQueue) each(f func(*job)) {
+	for round := 0; ; round++ {
+		found := false
+
+		for n := range len(q.order) {
+			jobs := q.jobs[q.order[(q.next+n)%len(q.order)]]
+			if round < len(jobs) {
+				f(jobs[round])
+
+				found = true
+			}
+		}
+
+		if !found {
+			return
+		}
 	}
 }
 
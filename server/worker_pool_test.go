@@ -0,0 +1,253 @@
+package server
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWorkerPoolQueuePositions(t *testing.T) {
+	t.Parallel()
+
+	pool := NewWorkerPool(1, 10, nil, GroupLimits{0, 0})
+
+	release := make(chan struct{})
+	started := make(chan struct{})
+
+	block := func(_ context.Context, _ int) {
+		close(started)
+		<-release
+	}
+
+	var mu sync.Mutex
+
+	aheads := map[int][]int{}
+
+	queued := func(id int) WorkOptions {
+		return WorkOptions{func(ahead int, _ time.Time) {
+			mu.Lock()
+			defer mu.Unlock()
+
+			aheads[id] = append(aheads[id], ahead)
+		}, "", PriorityInteractiveHTML}
+	}
+
+	if DoWork(context.Background(), pool, 0, block, queued(0)) == nil {
+		t.Fatal("expected work to be accepted")
+	}
+
+	<-started
+
+	for id := 1; id <= 2; id++ {
+		if DoWork(context.Background(), pool, id, func(context.Context, int) {}, queued(id)) == nil {
+			t.Fatal("expected work to be accepted")
+		}
+	}
+
+	close(release)
+
+	_ = pool.Close()
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if len(aheads[0]) != 0 {
+		t.Errorf("expected work for an idle pool to start without queueing, got %v", aheads[0])
+	}
+
+	if len(aheads[1]) != 1 || aheads[1][0] != 0 {
+		t.Errorf("expected the second work to be next in line, got %v", aheads[1])
+	}
+
+	if len(aheads[2]) != 2 || aheads[2][0] != 1 || aheads[2][1] != 0 {
+		t.Errorf("expected the third work to move up in line, got %v", aheads[2])
+	}
+}
+
+func TestWorkerPoolPriorities(t *testing.T) {
+	t.Parallel()
+
+	const (
+		h = PriorityInteractiveHTML
+		i = PriorityInteractiveImage
+		b = PriorityBackground
+	)
+
+	tests := []struct {
+		name    string
+		weights []int
+		queue   []Priority
+		want    []Priority
+		raise   int
+	}{
+		{"strict", nil, []Priority{b, i, h, i, h}, []Priority{h, h, i, i, b}, -1},
+		{"weighted", []int{2, 1, 1}, []Priority{h, h, h, h, b}, []Priority{h, h, b, h, h}, -1},
+		{"raised", nil, []Priority{b, i}, []Priority{b, i}, 0},
+	}
+
+	for _, tt := range tests {
+		pool := NewWorkerPool(1, 10, tt.weights, GroupLimits{0, 0})
+
+		release := make(chan struct{})
+		started := make(chan struct{})
+
+		// keeps the only worker busy without spending the credits of the priorities under test
+		DoWork(context.Background(), pool, 0, func(context.Context, int) {
+			close(started)
+			<-release
+		}, WorkOptions{nil, "", i})
+
+		<-started
+
+		var mu sync.Mutex
+
+		var got []Priority
+
+		tickets := make([]*Ticket, 0, len(tt.queue))
+
+		for _, p := range tt.queue {
+			tickets = append(tickets, DoWork(context.Background(), pool, p, func(_ context.Context, p Priority) {
+				mu.Lock()
+				defer mu.Unlock()
+
+				got = append(got, p)
+			}, WorkOptions{nil, "", p}))
+		}
+
+		if tt.raise >= 0 {
+			tickets[tt.raise].Raise(h)
+		}
+
+		close(release)
+
+		_ = pool.Close()
+
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("%s: expected %v, got %v", tt.name, tt.want, got)
+		}
+	}
+}
+
+func TestWorkerPoolGroupsTakeTurns(t *testing.T) {
+	t.Parallel()
+
+	pool := NewWorkerPool(1, 10, nil, GroupLimits{0, 0})
+
+	release := make(chan struct{})
+	started := make(chan struct{})
+
+	DoWork(context.Background(), pool, "", func(context.Context, string) {
+		close(started)
+		<-release
+	}, WorkOptions{nil, "x", PriorityInteractiveHTML})
+
+	<-started
+
+	var mu sync.Mutex
+
+	var got []string
+
+	for _, id := range []string{"a1", "a2", "a3", "b1", "c1", "b2"} {
+		DoWork(context.Background(), pool, id, func(_ context.Context, id string) {
+			mu.Lock()
+			defer mu.Unlock()
+
+			got = append(got, id)
+		}, WorkOptions{nil, id[:1], PriorityInteractiveHTML})
+	}
+
+	close(release)
+
+	_ = pool.Close()
+
+	want := []string{"a1", "b1", "c1", "a2", "b2", "a3"}
+	if !slices.Equal(got, want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+}
+
+func TestWorkerPoolGroupLimits(t *testing.T) {
+	t.Parallel()
+
+	pool := NewWorkerPool(2, 10, nil, GroupLimits{1, 1})
+
+	release := make(chan struct{})
+	started := make(chan string, 3)
+
+	do := func(_ context.Context, id string) {
+		started <- id
+
+		if id == "a1" {
+			<-release
+		}
+	}
+
+	DoWork(context.Background(), pool, "a1", do, WorkOptions{nil, "a", PriorityInteractiveHTML})
+
+	if id := <-started; id != "a1" {
+		t.Fatalf("expected a1 to start, got %s", id)
+	}
+
+	if DoWork(context.Background(), pool, "a2", do, WorkOptions{nil, "a", PriorityInteractiveHTML}) == nil {
+		t.Fatal("expected a2 to be queued")
+	}
+
+	if DoWork(context.Background(), pool, "a3", do, WorkOptions{nil, "a", PriorityInteractiveHTML}) != nil {
+		t.Fatal("expected a3 to be refused once a has its limit waiting")
+	}
+
+	if DoWork(context.Background(), pool, "b1", do, WorkOptions{nil, "b", PriorityInteractiveHTML}) == nil {
+		t.Fatal("expected b1 to be accepted")
+	}
+
+	// the idle worker skips a2, which would exceed the worker limit for a
+	if id := <-started; id != "b1" {
+		t.Fatalf("expected b1 to start while a1 runs, got %s", id)
+	}
+
+	close(release)
+
+	if id := <-started; id != "a2" {
+		t.Fatalf("expected a2 to start after a1, got %s", id)
+	}
+
+	_ = pool.Close()
+}
+
+func TestWorkerPoolShutdown(t *testing.T) {
+	t.Parallel()
+
+	pool := NewWorkerPool(1, 10, nil, GroupLimits{0, 0})
+
+	release := make(chan struct{})
+	started := make(chan struct{})
+
+	DoWork(context.Background(), pool, 0, func(context.Context, int) {
+		close(started)
+		<-release
+	}, WorkOptions{nil, "", PriorityInteractiveHTML})
+
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	if pool.Shutdown(ctx) == nil {
+		t.Error("expected shutdown to give up on unfinished work")
+	}
+
+	ticket := DoWork(
+		context.Background(), pool, 1, func(context.Context, int) {}, WorkOptions{nil, "", PriorityInteractiveHTML})
+	if ticket != nil {
+		t.Error("expected work to be refused after shutdown")
+	}
+
+	close(release)
+
+	err := pool.Shutdown(context.Background())
+	if err != nil {
+		t.Errorf("expected shutdown to finish once work is done, got %v", err)
+	}
+}
@@ -0,0 +1,65 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// TestSetup exports to a stand-in for an OTLP collector and checks the spans arrive. It is not parallel since it
+// sets the global tracer provider.
+//
+//nolint:paralleltest
+func TestSetup(t *testing.T) {
+	var mu sync.Mutex
+
+	var bodies []string
+
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/traces" {
+			http.NotFound(w, r)
+			return
+		}
+
+		body, _ := io.ReadAll(r.Body)
+
+		mu.Lock()
+		bodies = append(bodies, string(body))
+		mu.Unlock()
+
+		w.Header().Set("Content-Type", "application/x-protobuf")
+	}))
+	defer collector.Close()
+
+	shutdown, err := Setup(context.Background(), collector.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, parent := Start(context.Background(), "parent-span")
+	_, child := Start(ctx, "child-span")
+
+	End(child, errors.New("child failed"))
+	End(parent, nil)
+
+	err = shutdown(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	all := strings.Join(bodies, "")
+
+	for _, want := range []string{"parent-span", "child-span", "child failed", ServiceName} {
+		if !strings.Contains(all, want) {
+			t.Errorf("expected %q in exported spans", want)
+		}
+	}
+}